@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// aliasResult renames the single benchmark in each of the result files to
+// alias, so that benchstat compares them as the same benchmark. The renamed
+// copies are written to dir, and result is pointed at them. The copies are
+// removed by result.removeTempFiles.
+func aliasResult(result *RunResult, dir, alias string) error {
+	if !strings.HasPrefix(alias, "Benchmark") {
+		alias = "Benchmark" + alias
+	}
+	for _, path := range []*string{&result.BaseOutputFile, &result.HeadOutputFile} {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return err
+		}
+		var names []string
+		seen := make(map[string]bool)
+		data = rewriteBenchmarkNames(data, func(name string) string {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return alias
+		})
+		if len(names) != 1 {
+			return fmt.Errorf("%s: need exactly one benchmark to alias, found %d: %s",
+				*path, len(names), strings.Join(names, ", "))
+		}
+		out, err := writeTempFile(dir, "benchdiff-alias-*.out", data)
+		if err != nil {
+			return err
+		}
+		result.tempFiles = append(result.tempFiles, out)
+		*path = out
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// anonymizer replaces benchmark names with opaque tokens, consistently across
+// all the files it rewrites.
+type anonymizer struct {
+	tokens map[string]string
+	names  []string // in order of first appearance
+}
+
+func (a *anonymizer) token(name string) string {
+	if t, ok := a.tokens[name]; ok {
+		return t
+	}
+	if a.tokens == nil {
+		a.tokens = make(map[string]string)
+	}
+	t := fmt.Sprintf("Benchmark_a%d", len(a.names)+1)
+	a.tokens[name] = t
+	a.names = append(a.names, name)
+	return t
+}
+
+// rewrite returns data with every benchmark name replaced by its token.
+func (a *anonymizer) rewrite(data []byte) []byte {
+	return rewriteBenchmarkNames(data, a.token)
+}
+
+// rewriteBenchmarkNames returns data with the name of every benchmark result
+// line replaced by f(name). The GOMAXPROCS suffix is preserved.
+func rewriteBenchmarkNames(data []byte, f func(name string) string) []byte {
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if name, rest, ok := cutBenchmarkName(line); ok {
+			line = f(name) + rest
+		}
+		out.WriteString(line)
+	}
+	return []byte(out.String())
+}
+
+// cutBenchmarkName splits a benchmark result line into the benchmark name,
+// including any sub-benchmark path, and the rest of the line starting with
+// the GOMAXPROCS suffix, if any.
+func cutBenchmarkName(line string) (name, rest string, ok bool) {
+	if !strings.HasPrefix(line, "Benchmark") {
+		return "", "", false
+	}
+	end := strings.IndexAny(line, " \t\n")
+	if end < 0 {
+		end = len(line)
+	}
+	name, rest = line[:end], line[end:]
+	if i := strings.LastIndex(name, "-"); i > 0 && i < len(name)-1 &&
+		strings.Trim(name[i+1:], "0123456789") == "" {
+		name, rest = line[:i], line[i:]
+	}
+	return name, rest, true
+}
+
+// anonymizeResult rewrites the result files into anonymized copies in dir,
+// points result at them, and writes the token to name mapping to
+// mappingFile. The copies are removed by result.removeTempFiles.
+func anonymizeResult(result *RunResult, dir, mappingFile string) error {
+	var a anonymizer
+	files := []*string{&result.BaseOutputFile, &result.HeadOutputFile}
+	for i := range result.ExtraOutputFiles {
+		files = append(files, &result.ExtraOutputFiles[i])
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return err
+		}
+		out, err := writeTempFile(dir, "benchdiff-anonymized-*.out", a.rewrite(data))
+		if err != nil {
+			return err
+		}
+		result.tempFiles = append(result.tempFiles, out)
+		*path = out
+	}
+
+	var mapping strings.Builder
+	for _, name := range a.names {
+		fmt.Fprintf(&mapping, "%s\t%s\n", a.tokens[name], name)
+	}
+	return os.WriteFile(mappingFile, []byte(mapping.String()), 0o600)
+}
@@ -2,13 +2,150 @@
 // show the delta.
 //
 // By default, the base ref is HEAD and the head ref is the current worktree.
-// Use the -base-ref and -head-ref flags to specify different refs.
+// Use the -base-ref and -head-ref flags to specify different refs. To compare a
+// sequence of refs, like releases, list them with -refs instead of -base-ref:
+// the first one is the base, and the head comes last. The -since
+// flag selects as base ref the last commit on HEAD older than the given
+// duration, for example -since 168h to compare against last week. The
+// -against-latest-tag flag selects the most recent tag reachable from HEAD,
+// optionally restricted with -tag-match to tags matching a glob like "v*".
 //
-// To pass flags to "go test", pass them after a double dash. For example:
+// The -benchtime and -benchmem flags are passed to "go test". To pass other
+// flags, pass them after a double dash. For example:
 //
-//	benchdiff -- -benchmem
+//	benchdiff -benchmem -- -cpu 1,4
 //
-// Non-worktree runs are cached. To clear the cache, use the -clear-cache flag.
+// Each benchmark runs 6 times at each ref. More runs narrow the confidence
+// intervals and let benchstat detect smaller changes, at the cost of time. Use
+// the -count flag to change it. The count is part of the cache key, so results
+// are reused only for the same commit and the same count.
+//
+// The -only-changed-benchmarks flag restricts the run to benchmark functions
+// whose declaration was added or modified between the base and head refs, and
+// to all the benchmarks of packages whose non-test Go files changed.
+//
+// "benchdiff selftest" benchmarks the worktree twice and compares it against
+// itself. Any significant delta it reports is noise introduced by the
+// benchmarks or the machine, and is a lower bound on what can be trusted.
+//
+// The -warn-regression and -fail-regression flags check the significant
+// deltas reported by benchstat against a percentage, like -fail-regression 10%.
+// Regressions above either threshold are reported (as annotations when
+// running in GitHub Actions), and regressions above the failure threshold make
+// benchdiff exit with status 2. Other errors exit with status 1. Only changes
+// for the worse count as regressions: increases in most units, like sec/op or
+// B/op, and decreases in throughputs, like B/s. The -warnings-as-errors flag
+// treats regressions above the warning threshold like those above the failure
+// threshold, and requires -warn-regression. By default every unit is checked,
+// and the -regression-units flag restricts the checks to a comma-separated
+// list, like -regression-units sec/op,allocs/op. The units can also be given as printed
+// by "go test", like ns/op, and must be reported by some benchmark.
+//
+// The significance levels of the two directions can differ, to flag
+// regressions more strictly than improvements or the other way around. The
+// -regression-alpha flag sets the level for changes for the worse, and the
+// -alpha flag the one for changes for the better. Both default to benchstat's
+// 0.05. Which direction is which depends on the unit, as for the regression
+// checks. The regression checks only use -regression-alpha, and the "change"
+// field of -format json uses both. With -regression-alpha 0.01, a regression
+// with p=0.03 doesn't trigger the checks, and is reported as "~" in json. The
+// text, csv, and tsv reports come from benchstat, which has a single level:
+// they use -alpha for both directions, so they still show that delta.
+//
+// The -v flag prints the "go test" output to standard error as the benchmarks
+// run, instead of a progress bar.
+//
+// The -timeout flag limits the duration of the whole run. When it expires, or
+// on interrupt, the running benchmark is killed and the temporary worktrees
+// are removed before exiting.
+//
+// The -dry-run flag prints the commands that would check out refs and run the
+// benchmarks, without running them. Read-only git and go commands, needed to
+// resolve the refs and the cache, still run.
+//
+// The -labels flag replaces the column labels, which are the refs as
+// described by "git describe", with a comma-separated list, like
+// -labels before,after. Columns beyond the end of the list keep their label.
+// Labels can't be empty or contain "=".
+//
+// The -save-raw flag copies the "go test" output of each ref to the given
+// directory, named after the ref, for archival or to compare again later with
+// "benchstat -ignore commit". The files are saved before -anonymize or
+// -bench-alias rewrite them.
+//
+// The -anonymize flag replaces benchmark names in the report with stable
+// tokens like Benchmark_a1, and writes the mapping back to the real names to
+// the given file, so that results can be shared without revealing them.
+//
+// The -nice flag runs the benchmarks at the given scheduling priority, using
+// the nice command. Where the ionice command is available, like on Linux, it
+// also sets the best-effort I/O priority matching the CPU one, like the kernel
+// derives it by default. Elsewhere, only the CPU priority is set.
+//
+// If a benchmark was renamed, use -base-bench and -head-bench to select it by
+// its name at each ref, and -bench-alias to compare the two as one row.
+//
+// Benchmarks that are missing at some of the refs, for example because they
+// were added, removed, or renamed, are reported with a warning, since
+// benchstat just leaves their cells empty. The -fail-on-removed flag makes
+// benchdiff exit with status 2 if a benchmark present at the base ref is
+// missing at the head ref.
+//
+// The -show-subjects flag prints the subject line of each ref's commit above
+// the report, to make the abbreviated ref names easier to recognize. The
+// -show-commits flag prints the full commit hash of each ref, and the ref as
+// given when it differs from the label, like HEAD~1, so that archived reports
+// keep identifying the exact commits. Both only work with -format text.
+//
+// The -live flag runs the head ref benchmarks one -count iteration at a time,
+// printing an interim comparison after each, to watch the delta converge. The
+// interim comparisons are of the raw results, so -live only works with -format
+// text, and not with the flags that rewrite the results or the report, like
+// -anonymize or -labels.
+//
+// "benchdiff run-jobs spec.json" runs a list of comparisons described by a
+// JSON file, sharing the cache between them. See the job type for the format.
+// Each job prints a plain benchstat report of the refs it specifies, so the
+// flags that select refs or benchmarks, or change or check the report, like
+// -refs, -format, or -fail-regression, are rejected.
+//
+// With the -fetch flag, refs that are not available locally, as is common in
+// shallow CI checkouts, are fetched from the -remote (origin by default),
+// giving up after -fetch-timeout. Without -fetch, benchdiff never touches the
+// network.
+//
+// The -filter flag restricts the report and the regression, removed, and
+// missing benchmark checks to the benchmarks matching a benchfilter query,
+// such as ".name:/^Encode/". Since it applies to the saved results, it doesn't
+// invalidate the cache like changing the -bench pattern would. With
+// -bench-alias, it matches the alias. It can't be used with -anonymize.
+//
+// The -format flag selects the report format: benchstat's text or csv, tsv,
+// json (see the table type for the schema), or none to print no report at
+// all, for runs that only need the exit status of the regression checks. The
+// -no-range flag omits the confidence interval columns from csv and tsv, and
+// the -flat flag merges their tables into one, self-describing table with the
+// package and unit of each row in the first columns, for importing into a
+// database or a spreadsheet. The -color flag controls the coloring of text
+// deltas, which by default happens when printing to a terminal, unless the
+// NO_COLOR environment variable is set.
+//
+// The -expect flag checks the head ref against a file of expected values
+// instead of benchmarking the base ref. See parseExpectations for the format.
+// If any benchmark drifts from its expected value by more than the allowed
+// tolerance, benchdiff exits with status 2.
+//
+// Non-worktree runs are cached, keyed by the commit hash of the ref and the
+// benchmark flags, in the -cache-dir directory (benchdiff in the user cache
+// directory by default). The -no-cache flag ignores cached results, and the
+// -clear-cache flag deletes them.
+//
+// Refs are checked out in temporary worktrees. The -submodules flag
+// initializes their submodules too, which is off by default because it can be
+// slow. The -parallel flag benchmarks all refs at the same time, which is
+// faster, but the runs compete for CPU, memory bandwidth, and caches, so the
+// results are noisier and can be skewed if the refs' benchmarks run at
+// different times. Use it for quick checks, not for final numbers.
 //
 // Benchmarking the standard library is supported.
 //
@@ -20,17 +157,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 )
@@ -45,20 +191,173 @@ func getCacheDir() string {
 
 func main() {
 	clearCacheFlag := flag.Bool("clear-cache", false, "clear the cache")
+	noCache := flag.Bool("no-cache", false, "ignore cached results, re-running every benchmark")
+	cacheDir := flag.String("cache-dir", "", "cache `directory` (defaults to benchdiff in the user cache directory)")
 	baseRef := flag.String("base-ref", "HEAD", "base git ref")
+	countFlag := flag.Int("count", 6, "run each benchmark `n` times at each ref")
+	benchtime := flag.String("benchtime", "", "passed to go test: run each benchmark for `t`, like 2s or 1000x")
+	benchmem := flag.Bool("benchmem", false, "passed to go test: report memory allocations")
 	headRef := flag.String("head-ref", "", "head git ref (defaults to worktree)")
+	refsFlag := flag.String("refs", "", "comma-separated git `refs` to compare in order before the head ref, replacing -base-ref")
+	since := flag.Duration("since", 0, "use the last commit older than this as base ref")
+	againstLatestTag := flag.Bool("against-latest-tag", false, "use the most recent tag as base ref")
+	tagMatch := flag.String("tag-match", "", "only consider tags matching this glob for -against-latest-tag")
+	onlyChanged := flag.Bool("only-changed-benchmarks", false, "only run benchmarks modified between base and head")
+	var warnRegression, failRegression percentFlag
+	flag.Var(&warnRegression, "warn-regression", "warn about significant regressions larger than this `percentage`")
+	flag.Var(&failRegression, "fail-regression", "exit with status 2 on significant regressions larger than this `percentage`")
+	alphaFlag := flag.Float64("alpha", 0.05, "significance level for improvements, and for all changes in text, csv, and tsv reports")
+	regressionAlpha := flag.Float64("regression-alpha", 0.05, "significance level for regressions, in the regression checks and -format json")
+	regressionUnits := flag.String("regression-units", "", "comma-separated `units` checked by -warn-regression and -fail-regression (default all)")
+	warningsAsErrors := flag.Bool("warnings-as-errors", false, "treat -warn-regression regressions as failures")
+	failOnRemoved := flag.Bool("fail-on-removed", false, "exit with status 2 if a base ref benchmark is missing at head")
+	saveRaw := flag.String("save-raw", "", "copy the go test output of each ref to `directory`")
+	filter := flag.String("filter", "", "only report benchmarks matching this benchstat `query`, like .name:/Encode/")
+	anonymize := flag.String("anonymize", "", "replace benchmark names with tokens, writing the mapping to this `file`")
+	niceFlag := flag.Int("nice", 0, "run benchmarks with this niceness adjustment (negative values need privileges)")
+	baseBench := flag.String("base-bench", "", "benchmark `pattern` at the base ref, requires -bench-alias")
+	headBench := flag.String("head-bench", "", "benchmark `pattern` at the head ref, requires -bench-alias")
+	benchAlias := flag.String("bench-alias", "", "`name` to report the -base-bench and -head-bench benchmarks as")
+	labelsFlag := flag.String("labels", "", "comma-separated column `labels` to show instead of the refs, in order")
+	showCommits := flag.Bool("show-commits", false, "print the full commit hash and the name of each ref above the report")
+	showSubjects := flag.Bool("show-subjects", false, "print the commit subject of each ref above the report")
+	verbose := flag.Bool("v", false, "print the go test output as the benchmarks run")
+	dryRun := flag.Bool("dry-run", false, "print the commands that would check out refs and run benchmarks, without running them")
+	timeout := flag.Duration("timeout", 0, "give up on the whole run after this long, unlike go test's -timeout (0 means no limit)")
+	parallel := flag.Bool("parallel", false, "benchmark all refs at the same time (faster, but less accurate)")
+	live := flag.Bool("live", false, "print an interim comparison after each -count iteration at the head ref")
+	fetch := flag.Bool("fetch", false, "fetch refs missing locally from -remote")
+	remote := flag.String("remote", "origin", "git remote for -fetch")
+	fetchTimeout := flag.Duration("fetch-timeout", 2*time.Minute, "give up on -fetch after this long (0 means no limit)")
+	format := flag.String("format", "text", "report `format`: text, csv, tsv, json, or none")
+	colorFlag := flag.String("color", "auto", "color text deltas: auto, always, or never")
+	flat := flag.Bool("flat", false, "merge csv and tsv reports into one table, with package and unit columns")
+	noRange := flag.Bool("no-range", false, "omit confidence intervals from csv and tsv reports")
+	expect := flag.String("expect", "", "check the head ref against the expected values in `file`")
+	submodules := flag.Bool("submodules", false, "check out submodules at the base and head refs")
+	gitFlag := flag.String("git", "git", "git `binary`, as a path or a name to look up in PATH")
 	debugFlag := flag.Bool("debug", false, "enable debug output")
 
 	flag.Parse()
 
+	selftest := flag.Arg(0) == "selftest"
+	if selftest {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	var jobsFile string
+	if flag.Arg(0) == "run-jobs" {
+		if flag.NArg() < 2 {
+			log.Fatalf("usage: benchdiff run-jobs <spec.json> [-- go test flags]")
+		}
+		jobsFile = flag.Arg(1)
+		flag.CommandLine.Parse(flag.Args()[2:])
+	}
+
+	if (*baseBench != "" || *headBench != "" || *benchAlias != "") &&
+		(*baseBench == "" || *headBench == "" || *benchAlias == "") {
+		log.Fatalf("-base-bench, -head-bench, and -bench-alias must be used together")
+	}
+
+	switch *format {
+	case "text", "csv", "tsv", "json", "none":
+	default:
+		log.Fatalf("unknown -format %q, want text, csv, tsv, json, or none", *format)
+	}
+	if *flat && *format != "csv" && *format != "tsv" {
+		log.Fatalf("-flat requires -format csv or tsv")
+	}
+	if (*showSubjects || *showCommits) && *format != "text" {
+		// The header lines would break machine-readable output.
+		log.Fatalf("-show-subjects and -show-commits require -format text")
+	}
+	switch *colorFlag {
+	case "auto", "always", "never":
+	default:
+		log.Fatalf("unknown -color %q, want auto, always, or never", *colorFlag)
+	}
+	if *countFlag < 1 {
+		log.Fatalf("-count must be at least 1")
+	}
+	if *alphaFlag <= 0 || *alphaFlag > 1 {
+		log.Fatalf("-alpha must be in range (0, 1]")
+	}
+	if *regressionAlpha <= 0 || *regressionAlpha > 1 {
+		log.Fatalf("-regression-alpha must be in range (0, 1]")
+	}
+	if *dryRun && (jobsFile != "" || *expect != "" || *fetch || *live) {
+		log.Fatalf("-dry-run can't be used with run-jobs, -expect, -fetch, or -live")
+	}
+	if jobsFile != "" {
+		// run-jobs prints the plain benchstat report of each job, comparing
+		// the refs it specifies, so these would be silently ignored.
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, name := range []string{"format", "filter", "labels", "alpha",
+			"warn-regression", "fail-regression", "warnings-as-errors",
+			"fail-on-removed", "anonymize", "save-raw", "show-commits",
+			"show-subjects", "refs", "base-ref", "head-ref", "since",
+			"against-latest-tag", "only-changed-benchmarks", "expect", "live",
+			"fetch", "base-bench", "head-bench", "bench-alias", "no-range", "color"} {
+			if set[name] {
+				log.Fatalf("-%s can't be used with run-jobs", name)
+			}
+		}
+	}
+	if *parallel && *live {
+		log.Fatalf("-parallel and -live are mutually exclusive")
+	}
+	if *live && (*format != "text" || *anonymize != "" || *benchAlias != "" ||
+		*filter != "" || *labelsFlag != "") {
+		// The interim tables are plain benchstat text of the raw results.
+		log.Fatalf("-live requires -format text, and can't be used with -anonymize, -bench-alias, -filter, or -labels")
+	}
+	if *filter != "" && *anonymize != "" {
+		// The filter would select the real names, but apply to the tokens.
+		log.Fatalf("-filter and -anonymize are mutually exclusive")
+	}
+	if *regressionUnits != "" && !warnRegression.set && !failRegression.set {
+		log.Fatalf("-regression-units requires -warn-regression or -fail-regression")
+	}
+	if *warningsAsErrors && !warnRegression.set {
+		log.Fatalf("-warnings-as-errors requires -warn-regression")
+	}
+
+	var ioNice bool
+	if *niceFlag != 0 {
+		if _, err := exec.LookPath("nice"); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: nice is not available, ignoring -nice.\n")
+			*niceFlag = 0
+		} else if _, err := exec.LookPath("ionice"); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ionice is not available, -nice only sets the CPU priority.\n")
+		} else {
+			ioNice = true
+		}
+	}
+
+	if *refsFlag != "" && (*since != 0 || *againstLatestTag || *benchAlias != "") {
+		log.Fatalf("-refs can't be used with -since, -against-latest-tag, or -bench-alias")
+	}
+	if *since != 0 && *againstLatestTag {
+		log.Fatalf("-since and -against-latest-tag are mutually exclusive")
+	}
+	if *tagMatch != "" && !*againstLatestTag {
+		log.Fatalf("-tag-match requires -against-latest-tag")
+	}
+	if *filter != "" && *anonymize != "" {
+		log.Fatalf("-filter can't be used with -anonymize")
+	}
+
 	// Invoke caffeinate to prevent the system from sleeping. Best effort.
 	exec.Command("caffeinate", "-d").Start()
 
+	if *cacheDir == "" {
+		*cacheDir = getCacheDir()
+	}
+
 	if *clearCacheFlag {
-		cacheDir := getCacheDir()
-		files, err := filepath.Glob(filepath.Join(cacheDir, "benchdiff-*.out"))
+		files, err := filepath.Glob(filepath.Join(*cacheDir, "benchdiff-*.out"))
 		if err != nil {
-			log.Fatalf("error finding files in %s: %v", cacheDir, err)
+			log.Fatalf("error finding files in %s: %v", *cacheDir, err)
 		}
 		for _, file := range files {
 			err = os.Remove(file)
@@ -69,41 +368,432 @@ func main() {
 		os.Exit(0)
 	}
 
-	benchArgs := []string{"test", "-run", "^$", "-bench", ".", "-count", "6"}
-	benchArgs = append(benchArgs, flag.Args()...)
+	gitPath, err := exec.LookPath(*gitFlag)
+	if err != nil {
+		log.Fatalf("git not found: %v", err)
+	}
 
 	bd := &Benchdiff{
-		BenchArgs:  benchArgs,
-		ResultsDir: getCacheDir(),
+		Git:        gitPath,
+		ResultsDir: *cacheDir,
+		NoCache:    *noCache,
+		Submodules: *submodules,
+		Parallel:   *parallel,
+		DryRun:     *dryRun,
+		Verbose:    *verbose,
 		BaseRef:    *baseRef,
 		HeadRef:    *headRef,
+		BaseBench:  *baseBench,
+		HeadBench:  *headBench,
+		AllowEmpty: *baseBench != "",
+		Nice:       *niceFlag,
+		IONice:     ioNice,
 		Debug:      log.New(io.Discard, "", 0),
 	}
 	if *debugFlag {
 		bd.Debug = log.New(os.Stderr, "", 0)
 	}
-	result, err := bd.Run()
+	if *refsFlag != "" {
+		refs := strings.Split(*refsFlag, ",")
+		bd.BaseRef, bd.ExtraRefs = refs[0], refs[1:]
+	}
+	if *labelsFlag != "" {
+		// Check the labels before spending time on the benchmarks.
+		placeholder := &RunResult{ExtraRefs: make([]string, len(bd.ExtraRefs))}
+		if err := placeholder.relabel(strings.Split(*labelsFlag, ",")); err != nil {
+			log.Fatalf("error applying -labels: %v", err)
+		}
+	}
+	if *fetch {
+		refs := []*string{&bd.BaseRef, &bd.HeadRef}
+		for i := range bd.ExtraRefs {
+			refs = append(refs, &bd.ExtraRefs[i])
+		}
+		for _, ref := range refs {
+			if *ref == "" {
+				continue
+			}
+			resolved, err := bd.fetchIfMissing(*remote, *ref, *fetchTimeout)
+			if err != nil {
+				log.Fatalf("error fetching %s: %v", *ref, err)
+			}
+			*ref = resolved
+		}
+	}
+	if *since != 0 {
+		ref, err := bd.commitBefore(time.Now().Add(-*since))
+		if err != nil {
+			log.Fatalf("error resolving -since: %v", err)
+		}
+		bd.BaseRef = ref
+	}
+	if *againstLatestTag {
+		tag, err := bd.latestTag(*tagMatch)
+		if err != nil {
+			log.Fatalf("error resolving -against-latest-tag: %v", err)
+		}
+		bd.BaseRef = tag
+	}
+
+	testArgs := extraTestArgs(*benchtime, *benchmem, flag.Args())
+
+	// On interrupt or timeout, the running go test is killed, and the
+	// temporary worktrees are cleaned up before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if jobsFile != "" {
+		if err := bd.RunJobs(ctx, jobsFile, *countFlag, testArgs); err != nil {
+			log.Fatalf("error running jobs: %v", canceledErr(ctx, err))
+		}
+		os.Exit(0)
+	}
+
+	benchPattern := "."
+	if *onlyChanged {
+		names, err := bd.changedBenchmarks()
+		if err != nil {
+			log.Fatalf("error finding changed benchmarks: %v", err)
+		}
+		if len(names) == 0 {
+			fmt.Fprintf(os.Stderr, "No benchmarks changed.\n")
+			os.Exit(0)
+		}
+		bd.Debug.Printf("changed benchmarks: %v", names)
+		bd.AllowEmpty = true
+		benchPattern = "^(" + strings.Join(names, "|") + ")$"
+	}
+
+	bd.BenchArgs = goTestArgs(benchPattern, *countFlag, testArgs)
+
+	if *expect != "" {
+		ok, err := bd.checkExpectations(ctx, *expect)
+		if err != nil {
+			log.Fatalf("error checking expectations: %v", canceledErr(ctx, err))
+		}
+		if !ok {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	displayAlpha := strconv.FormatFloat(*alphaFlag, 'g', -1, 64)
+	if *live {
+		bd.Live = func(partial *RunResult, iteration, total int) {
+			fmt.Printf("After %d of %d iterations:\n", iteration, total)
+			cmd := partial.benchstatCmd("-alpha", displayAlpha)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				log.Fatalf("error running benchstat: %v", err)
+			}
+			fmt.Println()
+		}
+	}
+
+	var result *RunResult
+	if selftest {
+		result, err = bd.SelfTest(ctx)
+	} else {
+		result, err = bd.Run(ctx)
+	}
+	if err != nil {
+		log.Fatalf("error running benchmarks: %v", canceledErr(ctx, err))
+	}
+	if *dryRun {
+		result.removeTempFiles()
+		os.Exit(0)
+	}
+
+	if *saveRaw != "" {
+		saved, err := saveResult(result, *saveRaw)
+		if err != nil {
+			log.Fatalf("error saving raw output: %v", err)
+		}
+		for _, path := range saved {
+			fmt.Fprintf(os.Stderr, "Saved %s.\n", path)
+		}
+	}
+
+	if *labelsFlag != "" {
+		if err := result.relabel(strings.Split(*labelsFlag, ",")); err != nil {
+			log.Fatalf("error applying -labels: %v", err)
+		}
+	}
+
+	if *benchAlias != "" {
+		if err := aliasResult(result, bd.ResultsDir, *benchAlias); err != nil {
+			log.Fatalf("error applying -bench-alias: %v", err)
+		}
+	}
+
+	if *filter != "" {
+		result.Filter = *filter
+		var out bytes.Buffer
+		cmd := result.benchstatCmd("-format", "csv")
+		cmd.Stdout = &out
+		if err := runCmd(cmd, bd.Debug); err != nil {
+			log.Fatalf("error running benchstat: %v", err)
+		}
+		if tables, err := parseBenchstatCSV(out.Bytes()); err != nil {
+			log.Fatalf("error parsing benchstat output: %v", err)
+		} else if len(tables) == 0 {
+			log.Fatalf("no benchmarks match -filter %q", *filter)
+		}
+	}
+
+	if *anonymize != "" {
+		if err := anonymizeResult(result, bd.ResultsDir, *anonymize); err != nil {
+			log.Fatalf("error anonymizing results: %v", err)
+		}
+	}
+
+	if *format != "none" {
+		if *showSubjects || *showCommits {
+			refs := append([]string{bd.BaseRef}, bd.ExtraRefs...)
+			refs = append(refs, bd.HeadRef)
+			if selftest {
+				refs = []string{"", ""}
+			}
+			for i, label := range result.labels() {
+				line := *label + ":"
+				if *showCommits {
+					commit, err := bd.commitID(refs[i])
+					if err != nil {
+						log.Fatalf("error resolving %s: %v", *label, err)
+					}
+					line += " " + commit
+					if refs[i] == "" {
+						line += " (worktree)"
+					} else if refs[i] != *label {
+						line += " (" + refs[i] + ")"
+					}
+				}
+				if *showSubjects {
+					subject, err := bd.commitSubject(refs[i])
+					if err != nil {
+						log.Fatalf("error getting commit subject: %v", err)
+					}
+					line += " " + subject
+				}
+				fmt.Println(line)
+			}
+		}
+
+		if *format == "text" || *format == "csv" && !*noRange && !*flat {
+			// benchstat ignores errors writing its output, so it's buffered
+			// and written here, to notice a full disk or a closed pipe.
+			var out bytes.Buffer
+			cmd := result.benchstatCmd("-format", *format, "-alpha", displayAlpha)
+			cmd.Stdout = &out
+			cmd.Stderr = os.Stderr
+			bd.Debug.Printf("+ %s", cmd)
+			if err := cmd.Run(); err != nil {
+				log.Fatalf("error running benchstat: %v", err)
+			}
+			report := out.Bytes()
+			if *format == "text" && useColor(*colorFlag) {
+				report = colorize(report)
+			}
+			if err := writeReport(os.Stdout, report); err != nil {
+				log.Fatalf("error writing report: %v", err)
+			}
+		} else {
+			alpha := displayAlpha
+			if *format == "json" {
+				// Get every delta significant in either direction, and
+				// classify them below.
+				alpha = strconv.FormatFloat(max(*alphaFlag, *regressionAlpha), 'g', -1, 64)
+			}
+			var out bytes.Buffer
+			cmd := result.benchstatCmd("-format", "csv", "-alpha", alpha)
+			cmd.Stdout = &out
+			if err := runCmd(cmd, bd.Debug); err != nil {
+				log.Fatalf("error running benchstat: %v", err)
+			}
+			var report []byte
+			switch *format {
+			case "json":
+				tables, err := parseBenchstatCSV(out.Bytes())
+				if err != nil {
+					log.Fatalf("error parsing benchstat output: %v", err)
+				}
+				if tables == nil {
+					tables = []*table{}
+				}
+				applyAlphas(tables, *alphaFlag, *regressionAlpha)
+				report, err = json.MarshalIndent(tables, "", "\t")
+				if err != nil {
+					log.Fatalf("error encoding JSON: %v", err)
+				}
+				report = append(report, '\n')
+			case "csv":
+				report, err = redelimit(out.Bytes(), ',', *noRange, *flat)
+			case "tsv":
+				report, err = redelimit(out.Bytes(), '\t', *noRange, *flat)
+			}
+			if err != nil {
+				log.Fatalf("error formatting report: %v", err)
+			}
+			if err := writeReport(os.Stdout, report); err != nil {
+				log.Fatalf("error writing report: %v", err)
+			}
+		}
+		if selftest {
+			fmt.Fprintf(os.Stderr, "Both runs measured the same code: any delta is measurement noise.\n")
+		}
+	}
+
+	var failed bool
+	if warnRegression.set || failRegression.set {
+		var out bytes.Buffer
+		alpha := strconv.FormatFloat(*regressionAlpha, 'g', -1, 64)
+		cmd := result.benchstatCmd("-format", "csv", "-alpha", alpha)
+		cmd.Stdout = &out
+		if err := runCmd(cmd, bd.Debug); err != nil {
+			log.Fatalf("error running benchstat: %v", err)
+		}
+		tables, err := parseBenchstatCSV(out.Bytes())
+		if err != nil {
+			log.Fatalf("error parsing benchstat output: %v", err)
+		}
+		units := make(map[string]bool)
+		for _, u := range strings.Split(*regressionUnits, ",") {
+			if u == "" {
+				continue
+			}
+			u = benchstatUnit(u)
+			if !slices.ContainsFunc(tables, func(t *table) bool { return benchstatUnit(t.Unit) == u }) {
+				// Don't let a typo silently disable the checks.
+				log.Fatalf("-regression-units: no benchmark reports %s", u)
+			}
+			units[u] = true
+		}
+		for _, ch := range changes(tables) {
+			if len(units) > 0 && !units[benchstatUnit(ch.Unit)] {
+				continue
+			}
+			r, ok := ch.regression()
+			switch {
+			case !ok:
+			case failRegression.set && r > failRegression.value:
+				report("error", "regression over "+failRegression.String(), ch.String())
+				failed = true
+			case warnRegression.set && r > warnRegression.value && *warningsAsErrors:
+				report("error", "regression over "+warnRegression.String(), ch.String())
+				failed = true
+			case warnRegression.set && r > warnRegression.value:
+				report("warning", "regression over "+warnRegression.String(), ch.String())
+			}
+		}
+	}
+	var removed []string
+	if *failOnRemoved {
+		removed, err = result.removedBenchmarks()
+		if err != nil {
+			log.Fatalf("error comparing benchmark sets: %v", err)
+		}
+		for _, name := range removed {
+			report("error", "benchmark removed", name)
+			failed = true
+		}
+	}
+	mismatched, err := result.mismatchedBenchmarks()
 	if err != nil {
-		log.Fatalf("error running benchmarks: %v", err)
+		log.Fatalf("error comparing benchmark sets: %v", err)
+	}
+	for _, m := range mismatched {
+		if slices.Contains(removed, m.Name) {
+			continue
+		}
+		report("warning", "benchmark missing", m.Name+" at "+strings.Join(m.MissingAt, ", "))
 	}
+	result.removeTempFiles()
+	if failed {
+		os.Exit(2)
+	}
+}
 
-	cmd := exec.Command("benchstat",
-		result.BaseRef+"="+result.BaseOutputFile,
-		result.HeadRef+"="+result.HeadOutputFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	bd.Debug.Printf("+ %s", cmd)
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("error running benchstat: %v", err)
+// benchstatUnit returns the name benchstat uses for a "go test" unit, which
+// differs for the time and throughput units. benchstat keeps the "go test"
+// name for some tables, like those where every value is zero, so both sides
+// of a comparison need to go through it.
+func benchstatUnit(unit string) string {
+	switch unit {
+	case "ns/op":
+		return "sec/op"
+	case "MB/s":
+		return "B/s"
 	}
+	return unit
+}
+
+// canceledErr returns the reason ctx is done, if it is, instead of err, which
+// is likely an uninformative "signal: killed" from the interrupted command.
+func canceledErr(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return errors.New("timed out")
+	case context.Canceled:
+		return errors.New("interrupted")
+	}
+	return err
+}
+
+// useColor reports whether to color the text report, given the -color flag.
+func useColor(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// report prints a message at the given level, "warning" or "error", to
+// standard error, to keep the report on standard output machine-readable. In
+// GitHub Actions, it's printed as an annotation, which the runner also picks
+// up from standard error.
+func report(level, title, msg string) {
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		fmt.Fprintf(os.Stderr, "::%s title=%s::%s\n", level, title, msg)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s%s: %s: %s\n", strings.ToUpper(level[:1]), level[1:], title, msg)
 }
 
 type Benchdiff struct {
+	Git        string // path to the git binary, "git" in PATH if empty
 	BenchArgs  []string
 	ResultsDir string
 	BaseRef    string
 	HeadRef    string
+	ExtraRefs  []string // compared in order between BaseRef and HeadRef
+	BaseBench  string   // if set, overrides the -bench pattern at BaseRef
+	HeadBench  string   // if set, overrides the -bench pattern at HeadRef
+	NoCache    bool     // if set, cached results are ignored and overwritten
+	Submodules bool     // if set, submodules are checked out at each ref
+	Parallel   bool     // if set, Run benchmarks all refs concurrently
+	DryRun     bool     // if set, commands with side effects are only printed
+	Verbose    bool     // if set, the go test output is copied to stderr
+	AllowEmpty bool     // if set, a ref without benchmark results is not an error
+	Nice       int
+	IONice     bool // if set, Nice also sets the I/O priority, with ionice
 	Debug      *log.Logger
+
+	// Live, if set, makes Run benchmark the head ref one -count iteration at
+	// a time, and is called with the partial results after each but the last.
+	Live func(partial *RunResult, iteration, total int)
 }
 
 type RunResult struct {
@@ -111,6 +801,119 @@ type RunResult struct {
 	BaseOutputFile string
 	HeadRef        string
 	BaseRef        string
+
+	// ExtraRefs and ExtraOutputFiles correspond to Benchdiff.ExtraRefs.
+	ExtraRefs        []string
+	ExtraOutputFiles []string
+
+	// tempFiles are output files that are not part of the cache, like the
+	// selftest results, and are deleted by removeTempFiles.
+	tempFiles []string
+
+	// Filter, if not empty, is a benchfilter query selecting the benchmarks
+	// to report. See golang.org/x/perf/cmd/benchfilter for the syntax.
+	Filter string
+}
+
+// goTestArgs returns the "go test" arguments to run the benchmarks matching
+// pattern count times, followed by the user-supplied extra arguments.
+func goTestArgs(pattern string, count int, extra []string) []string {
+	args := []string{"test", "-run", "^$", "-bench", pattern, "-count", strconv.Itoa(count)}
+	return append(args, extra...)
+}
+
+// extraTestArgs returns the "go test" arguments for the -benchtime and
+// -benchmem flags, followed by args, the ones after the double dash. Those
+// come last, so they take precedence. An empty benchtime and a false benchmem
+// add nothing, keeping the go test defaults.
+func extraTestArgs(benchtime string, benchmem bool, args []string) []string {
+	var testArgs []string
+	if benchtime != "" {
+		testArgs = append(testArgs, "-benchtime", benchtime)
+	}
+	if benchmem {
+		testArgs = append(testArgs, "-benchmem")
+	}
+	return append(testArgs, args...)
+}
+
+// relabel replaces the labels of the refs in result, in order from the base to
+// the head, with labels. Refs beyond the end of labels keep their label, which
+// is disambiguated if it clashes with one of labels.
+func (r *RunResult) relabel(labels []string) error {
+	refs := r.labels()
+	if len(labels) > len(refs) {
+		return fmt.Errorf("%d labels for %d refs", len(labels), len(refs))
+	}
+	seen := make(map[string]bool)
+	for i, label := range labels {
+		// benchstat takes the labels as label=file arguments.
+		if label == "" || strings.Contains(label, "=") {
+			return fmt.Errorf("invalid label %q", label)
+		}
+		// benchstat would merge columns with the same label.
+		if seen[label] {
+			return fmt.Errorf("duplicate label %q", label)
+		}
+		seen[label] = true
+		*refs[i] = label
+	}
+	r.disambiguate()
+	return nil
+}
+
+// labels returns pointers to the labels of the refs in result, in order from
+// the base to the head.
+func (r *RunResult) labels() []*string {
+	refs := []*string{&r.BaseRef}
+	for i := range r.ExtraRefs {
+		refs = append(refs, &r.ExtraRefs[i])
+	}
+	return append(refs, &r.HeadRef)
+}
+
+// disambiguate appends "#2", "#3", and so on to repeated labels, which
+// benchstat would otherwise merge into one column. Labels repeat when
+// comparing a commit with a clean worktree, or a tag with itself. A suffixed
+// label never clashes with another label.
+func (r *RunResult) disambiguate() {
+	labels := r.labels()
+	taken := make(map[string]bool)
+	for _, label := range labels {
+		taken[*label] = true
+	}
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		if seen[*label] {
+			name := *label
+			for n := 2; taken[name]; n++ {
+				name = fmt.Sprintf("%s#%d", *label, n)
+			}
+			*label = name
+			taken[name] = true
+		}
+		seen[*label] = true
+	}
+}
+
+// removeTempFiles deletes the output files that are not part of the cache.
+func (r *RunResult) removeTempFiles() {
+	for _, file := range r.tempFiles {
+		os.Remove(file)
+	}
+	r.tempFiles = nil
+}
+
+func (r *RunResult) benchstatCmd(args ...string) *exec.Cmd {
+	if r.Filter != "" {
+		args = append(args, "-filter", r.Filter)
+	}
+	args = append(args, "-ignore", "commit", r.BaseRef+"="+r.BaseOutputFile)
+	for i, ref := range r.ExtraRefs {
+		args = append(args, ref+"="+r.ExtraOutputFiles[i])
+	}
+	args = append(args, r.HeadRef+"="+r.HeadOutputFile)
+	return exec.Command("benchstat", args...)
 }
 
 func fileExists(path string) bool {
@@ -145,9 +948,9 @@ func runCmd(cmd *exec.Cmd, debug *log.Logger) error {
 
 var errCached = fmt.Errorf("cached")
 
-func (c *Benchdiff) runBenchmark(ref, filename string, count int) error {
+func (c *Benchdiff) runBenchmark(ctx context.Context, ref string, args []string, filename string, count int) error {
 	c.Debug.Printf("output file: %s", filename)
-	if ref != "" && fileExists(filename) {
+	if ref != "" && !c.NoCache && fileExists(filename) {
 		return errCached
 	}
 
@@ -160,10 +963,16 @@ func (c *Benchdiff) runBenchmark(ref, filename string, count int) error {
 		}
 	}
 
-	progress := pb.Simple.Start(count)
+	progress := pb.Simple.New(count)
+	if c.Parallel || c.DryRun || c.Verbose {
+		// Concurrent progress bars would garble each other, and the verbose
+		// output shows the progress already.
+		progress.SetWriter(io.Discard)
+	}
+	progress.Start()
 	defer progress.Finish()
 
-	cmd := exec.Command("go", c.BenchArgs...)
+	cmd := exec.CommandContext(ctx, "go", args...)
 
 	stdlib := false
 	if rootPath, err := c.runGitCmd("rev-parse", "--show-toplevel"); err == nil {
@@ -178,16 +987,23 @@ func (c *Benchdiff) runBenchmark(ref, filename string, count int) error {
 	}
 
 	fileBuffer := &bytes.Buffer{}
+	var results int
 	cmd.Stdout = io.MultiWriter(fileBuffer, &TestOutputWriter{f: func(line string) {
-		if strings.HasPrefix(line, "Benchmark") && strings.Contains(line, "\t") {
+		parts := strings.Split(line, "\t")
+		// An interrupted benchmark prints its name with no results.
+		if strings.HasPrefix(line, "Benchmark") && len(parts) >= 3 {
+			results++
 			progress.Increment()
-			parts := strings.Split(line, "\t")
 			name := strings.TrimSpace(parts[0])
 			name, _, _ = strings.Cut(name, "-")
 			time := strings.TrimSpace(parts[2])
 			progress.Set("prefix", name+" "+time+" |")
 		}
 	}})
+	if c.Verbose {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, os.Stderr)
+		cmd.Stderr = os.Stderr
+	}
 
 	if !stdlib {
 		goVersion, err := c.runGoCmd("env", "GOVERSION")
@@ -197,23 +1013,31 @@ func (c *Benchdiff) runBenchmark(ref, filename string, count int) error {
 		fmt.Fprintf(fileBuffer, "go: %s\n", goVersion)
 	}
 
+	// Record the commit, so that saved output files are self-describing.
+	// benchstat is told to ignore it, or it would split the tables by it.
+	commit, err := c.commitID(ref)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(fileBuffer, "commit: %s\n", commit)
+
 	var runErr error
 	if ref == "" {
-		runErr = runCmd(cmd, c.Debug)
+		runErr = c.runOrPrint(c.niced(ctx, cmd))
 	} else {
-		err := c.runAtGitRef(c.BaseRef, func(workPath string) {
+		err := c.runAtGitRef(ctx, ref, func(workPath string) {
 			if stdlib {
-				makeCmd := exec.Command(filepath.Join(workPath, "src", "make.bash"))
+				makeCmd := exec.CommandContext(ctx, filepath.Join(workPath, "src", "make.bash"))
 				makeCmd.Dir = filepath.Join(workPath, "src")
 				makeCmd.Env = append(os.Environ(), "GOOS=", "GOARCH=")
-				runErr = runCmd(makeCmd, c.Debug)
+				runErr = c.runOrPrint(makeCmd)
 				if runErr != nil {
 					return
 				}
 				cmd.Path = filepath.Join(workPath, "bin", "go")
 			}
 			cmd.Dir = workPath // TODO: add relative path of working directory
-			runErr = runCmd(cmd, c.Debug)
+			runErr = c.runOrPrint(c.niced(ctx, cmd))
 		})
 		if err != nil {
 			return err
@@ -222,15 +1046,151 @@ func (c *Benchdiff) runBenchmark(ref, filename string, count int) error {
 	if runErr != nil {
 		return runErr
 	}
+	if c.DryRun {
+		return nil
+	}
+	where := "at " + ref
+	if ref == "" {
+		where = "in the worktree"
+	}
+	if results == 0 && !c.AllowEmpty {
+		// Likely a -bench pattern that matches nothing. Don't cache it.
+		return fmt.Errorf("go test printed no benchmark results %s", where)
+	}
+	if results == 0 {
+		// A benchmark selected by -only-changed-benchmarks or -base-bench
+		// might legitimately not exist at one of the refs.
+		fmt.Fprintf(os.Stderr, "Warning: go test printed no benchmark results %s.\n", where)
+	}
 	return os.WriteFile(filename, fileBuffer.Bytes(), 0o666)
 }
 
-func (c *Benchdiff) countBenchmarks() (int, error) {
+// niced returns cmd wrapped to run with the Nice adjustment, if any, and the
+// matching I/O priority if IONice is set.
+func (c *Benchdiff) niced(ctx context.Context, cmd *exec.Cmd) *exec.Cmd {
+	if c.Nice == 0 {
+		return cmd
+	}
+	args := append([]string{"nice", "-n", strconv.Itoa(c.Nice), cmd.Path}, cmd.Args[1:]...)
+	if c.IONice {
+		// The best-effort class has levels 0 to 7, and the kernel maps the
+		// nice values -20 to 19 to them in steps of 5.
+		level := (min(max(c.Nice, -20), 19) + 20) / 5
+		args = append([]string{"ionice", "-c", "2", "-n", strconv.Itoa(level)}, args...)
+	}
+	n := exec.CommandContext(ctx, args[0], args[1:]...)
+	n.Dir, n.Env = cmd.Dir, cmd.Env
+	n.Stdout, n.Stderr = cmd.Stdout, cmd.Stderr
+	return n
+}
+
+// runBenchmarkLive is like runBenchmark, but runs the benchmarks one -count
+// iteration at a time, calling c.Live after each one with result modified to
+// point at the output accumulated so far.
+func (c *Benchdiff) runBenchmarkLive(ctx context.Context, ref string, args []string, filename string, count int, result RunResult) error {
+	if ref != "" && !c.NoCache && fileExists(filename) {
+		return errCached
+	}
+
+	// Partial results go to separate files, so that an interrupted run is
+	// never mistaken for a cached one. They are unique to this run, since the
+	// results directory can be shared by concurrent ones.
+	iterFile, err := c.tempFile("benchdiff-live-iteration-*.out")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(iterFile)
+	result.HeadOutputFile, err = c.tempFile("benchdiff-live-*.out")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(result.HeadOutputFile)
+
+	total := countArg(args)
+	iterArgs := append(append([]string(nil), args...), "-count", "1")
+	var out []byte
+	for i := 1; i <= total; i++ {
+		if err := os.Remove(iterFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := c.runBenchmark(ctx, ref, iterArgs, iterFile, count/total); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(iterFile)
+		if err != nil {
+			return err
+		}
+		out = append(out, data...)
+		if i == total {
+			break
+		}
+		if err := os.WriteFile(result.HeadOutputFile, out, 0o666); err != nil {
+			return err
+		}
+		c.Live(&result, i, total)
+	}
+	return os.WriteFile(filename, out, 0o666)
+}
+
+// tempFile creates an empty file in the results directory with a unique name
+// generated from pattern, like os.CreateTemp, and returns its path.
+func (c *Benchdiff) tempFile(pattern string) (string, error) {
+	return writeTempFile(c.ResultsDir, pattern, nil)
+}
+
+// writeTempFile writes data to a new file in dir with a unique name generated
+// from pattern, like os.CreateTemp, and returns its path.
+func writeTempFile(dir, pattern string, data []byte) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// countArg returns the value of the last -count flag in the "go test" args,
+// or its default of 1.
+func countArg(args []string) int {
+	count := 1
+	for i, arg := range args {
+		if arg == "-args" || arg == "--args" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "-"), "=")
+		if name != "-count" && name != "count" {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				break
+			}
+			value = args[i+1]
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			count = n
+		}
+	}
+	return count
+}
+
+func (c *Benchdiff) countBenchmarks(ctx context.Context, args []string) (int, error) {
+	if c.DryRun {
+		// Counting runs the benchmarks, briefly.
+		return 0, nil
+	}
 	var count int
 
-	benchArgs := append([]string(nil), c.BenchArgs...)
+	benchArgs := append([]string(nil), args...)
 	benchArgs = append(benchArgs, "-benchtime", "1ns", "-run", "^$")
-	cmd := exec.Command("go", benchArgs...)
+	cmd := exec.CommandContext(ctx, "go", benchArgs...)
 	cmd.Stdout = &TestOutputWriter{f: func(line string) {
 		if strings.HasPrefix(line, "Benchmark") && strings.Contains(line, "\t") {
 			count++
@@ -241,10 +1201,13 @@ func (c *Benchdiff) countBenchmarks() (int, error) {
 	return count, err
 }
 
-func (c *Benchdiff) Run() (result *RunResult, err error) {
+func (c *Benchdiff) Run(ctx context.Context) (result *RunResult, err error) {
 	if err := os.MkdirAll(c.ResultsDir, 0o700); err != nil {
 		return nil, err
 	}
+	if err := c.checkRefs(append([]string{c.BaseRef, c.HeadRef}, c.ExtraRefs...)...); err != nil {
+		return nil, err
+	}
 
 	headFlag := "--dirty"
 	if c.HeadRef != "" {
@@ -254,7 +1217,8 @@ func (c *Benchdiff) Run() (result *RunResult, err error) {
 	if err != nil {
 		return nil, err
 	}
-	headFilename, err := c.cacheFilename(string(headRef))
+	headArgs := c.benchArgs(c.HeadBench)
+	headFilename, err := c.cacheFilename(c.HeadRef, headArgs)
 	if err != nil {
 		return nil, err
 	}
@@ -263,13 +1227,14 @@ func (c *Benchdiff) Run() (result *RunResult, err error) {
 	if err != nil {
 		return nil, err
 	}
-	baseFilename, err := c.cacheFilename(string(baseRef))
+	baseArgs := c.benchArgs(c.BaseBench)
+	baseFilename, err := c.cacheFilename(c.BaseRef, baseArgs)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: use base-ref cache if available.
-	count, err := c.countBenchmarks()
+	count, err := c.countBenchmarks(ctx, headArgs)
 	if err != nil {
 		return nil, err
 	}
@@ -284,22 +1249,157 @@ func (c *Benchdiff) Run() (result *RunResult, err error) {
 
 	// TODO: interleave runs?
 
-	if err := c.runBenchmark(c.BaseRef, baseFilename, count); err == errCached {
-		fmt.Fprintf(os.Stderr, "Using cached benchmark for %s.\n", result.HeadRef)
-	} else if err != nil {
+	for _, ref := range c.ExtraRefs {
+		label, err := c.runGitCmd("describe", "--tags", "--always", ref)
+		if err != nil {
+			return nil, err
+		}
+		filename, err := c.cacheFilename(ref, baseArgs)
+		if err != nil {
+			return nil, err
+		}
+		result.ExtraRefs = append(result.ExtraRefs, string(label))
+		result.ExtraOutputFiles = append(result.ExtraOutputFiles, filename)
+	}
+	result.disambiguate()
+
+	runHead := c.runBenchmark
+	if c.Live != nil {
+		runHead = func(ctx context.Context, ref string, args []string, filename string, count int) error {
+			return c.runBenchmarkLive(ctx, ref, args, filename, count, *result)
+		}
+	}
+
+	type run struct {
+		ref, label, filename string
+		args                 []string
+		benchmark            func(ctx context.Context, ref string, args []string, filename string, count int) error
+	}
+	runs := []run{{c.BaseRef, result.BaseRef, baseFilename, baseArgs, c.runBenchmark}}
+	for i, ref := range c.ExtraRefs {
+		runs = append(runs, run{ref, result.ExtraRefs[i], result.ExtraOutputFiles[i], baseArgs, c.runBenchmark})
+	}
+	runs = append(runs, run{c.HeadRef, result.HeadRef, headFilename, headArgs, runHead})
+
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, r := range runs {
+		do := func() {
+			err := r.benchmark(ctx, r.ref, r.args, r.filename, count)
+			if err == errCached {
+				fmt.Fprintf(os.Stderr, "Using cached benchmark for %s.\n", r.label)
+			} else if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", r.label, err)
+			}
+		}
+		if c.Parallel || c.Verbose {
+			fmt.Fprintf(os.Stderr, "Benchmarking %s.\n", r.label)
+		}
+		if !c.Parallel {
+			do()
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do()
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
 		return nil, err
 	}
 
-	if err := c.runBenchmark(c.HeadRef, headFilename, count); err == errCached {
-		fmt.Fprintf(os.Stderr, "Using cached benchmark for %s.\n", result.BaseRef)
-	} else if err != nil {
+	return result, nil
+}
+
+// SelfTest benchmarks the worktree twice, to measure how much noise the
+// benchmarking process introduces. The results are never reused.
+func (c *Benchdiff) SelfTest(ctx context.Context) (*RunResult, error) {
+	if err := os.MkdirAll(c.ResultsDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	args := c.benchArgs("")
+	count, err := c.countBenchmarks(ctx, args)
+	if err != nil {
 		return nil, err
 	}
+	c.Debug.Printf("counted %d benchmarks", count)
 
+	result := &RunResult{BaseRef: "first", HeadRef: "second"}
+	for _, file := range []*string{&result.BaseOutputFile, &result.HeadOutputFile} {
+		*file, err = c.tempFile("benchdiff-selftest-*.out")
+		if err != nil {
+			result.removeTempFiles()
+			return nil, err
+		}
+		result.tempFiles = append(result.tempFiles, *file)
+		if err := c.runBenchmark(ctx, "", args, *file, count); err != nil {
+			result.removeTempFiles()
+			return nil, err
+		}
+	}
 	return result, nil
 }
 
-func (c *Benchdiff) cacheFilename(ref string) (string, error) {
+// RunHead benchmarks only the head ref, and returns its label and output file.
+func (c *Benchdiff) RunHead(ctx context.Context) (ref, filename string, err error) {
+	if err := os.MkdirAll(c.ResultsDir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := c.checkRefs(c.HeadRef); err != nil {
+		return "", "", err
+	}
+
+	headFlag := "--dirty"
+	if c.HeadRef != "" {
+		headFlag = c.HeadRef
+	}
+	headRef, err := c.runGitCmd("describe", "--tags", "--always", headFlag)
+	if err != nil {
+		return "", "", err
+	}
+	args := c.benchArgs(c.HeadBench)
+	filename, err = c.cacheFilename(c.HeadRef, args)
+	if err != nil {
+		return "", "", err
+	}
+	count, err := c.countBenchmarks(ctx, args)
+	if err != nil {
+		return "", "", err
+	}
+	c.Debug.Printf("counted %d benchmarks", count)
+
+	if err := c.runBenchmark(ctx, c.HeadRef, args, filename, count); err == errCached {
+		fmt.Fprintf(os.Stderr, "Using cached benchmark for %s.\n", headRef)
+	} else if err != nil {
+		return "", "", err
+	}
+	return string(headRef), filename, nil
+}
+
+// benchArgs returns BenchArgs, with the -bench pattern overridden if pattern
+// is not empty.
+func (c *Benchdiff) benchArgs(pattern string) []string {
+	args := append([]string(nil), c.BenchArgs...)
+	if pattern != "" {
+		args = append(args, "-bench", pattern)
+	}
+	return args
+}
+
+// cacheFilename returns the output file for running "go test" with args at
+// ref. It's keyed by commit hash rather than by the name of ref, so that
+// moved branches and tags don't hit stale results.
+func (c *Benchdiff) cacheFilename(ref string, args []string) (string, error) {
+	commit, err := c.commitID(ref)
+	if err != nil {
+		return "", err
+	}
 	env, err := c.runGoCmd("env", "GOARCH", "GOEXPERIMENT", "GOOS", "GOVERSION", "CC", "CXX", "CGO_ENABLED", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_LDFLAGS")
 	if err != nil {
 		return "", err
@@ -313,9 +1413,13 @@ func (c *Benchdiff) cacheFilename(ref string) (string, error) {
 	if buildInfo, ok := debug.ReadBuildInfo(); ok {
 		fmt.Fprintf(h, "%s\n", buildInfo.String())
 	}
-	fmt.Fprintf(h, "%q\n", c.BenchArgs)
+	fmt.Fprintf(h, "%q\n", args)
 	fmt.Fprintf(h, "%s\n", env)
-	fmt.Fprintf(h, "%s\n", ref)
+	fmt.Fprintf(h, "%s\n", commit)
+	if ref == "" {
+		// Keep a clean worktree from overwriting the results of its commit.
+		fmt.Fprintf(h, "worktree\n")
+	}
 	fmt.Fprintf(h, "%s\n", rootPath)
 	cacheKey := base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
 
@@ -330,15 +1434,185 @@ func (c *Benchdiff) runGoCmd(args ...string) ([]byte, error) {
 	return bytes.TrimSpace(stdout.Bytes()), err
 }
 
+func (c *Benchdiff) gitPath() string {
+	if c.Git == "" {
+		return "git"
+	}
+	return c.Git
+}
+
+// runOrPrint runs a command that has side effects, or only prints it if
+// DryRun is set.
+func (c *Benchdiff) runOrPrint(cmd *exec.Cmd) error {
+	if c.DryRun {
+		if cmd.Dir != "" {
+			fmt.Fprintf(os.Stderr, "+ cd %s && %s\n", cmd.Dir, cmd)
+		} else {
+			fmt.Fprintf(os.Stderr, "+ %s\n", cmd)
+		}
+		return nil
+	}
+	if cmd.Cancel != nil {
+		interruptOnCancel(cmd)
+		cmd.WaitDelay = 10 * time.Second
+	}
+	return runCmd(cmd, c.Debug)
+}
+
 func (c *Benchdiff) runGitCmd(args ...string) ([]byte, error) {
+	return c.runGitCmdContext(context.Background(), args...)
+}
+
+func (c *Benchdiff) runGitCmdContext(ctx context.Context, args ...string) ([]byte, error) {
 	var stdout bytes.Buffer
-	cmd := exec.Command("git", args...)
+	cmd := exec.CommandContext(ctx, c.gitPath(), args...)
 	cmd.Stdout = &stdout
 	err := runCmd(cmd, c.Debug)
 	return bytes.TrimSpace(stdout.Bytes()), err
 }
 
-func (c *Benchdiff) runAtGitRef(ref string, fn func(path string)) error {
+// checkRefs returns an error naming the first of refs that doesn't resolve to
+// a commit. Empty refs, meaning the worktree, are skipped.
+func (c *Benchdiff) checkRefs(refs ...string) error {
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		if _, err := c.commitID(ref); err != nil {
+			return fmt.Errorf("unknown ref %q: not a commit", ref)
+		}
+	}
+	return nil
+}
+
+// commitID returns the full hash of the commit at ref, or of HEAD followed by
+// "-dirty" if ref is empty and the worktree has uncommitted changes.
+func (c *Benchdiff) commitID(ref string) (string, error) {
+	if ref != "" {
+		out, err := c.runGitCmd("rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+		return string(out), err
+	}
+	out, err := c.runGitCmd("rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	status, err := c.runGitCmd("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return "", err
+	}
+	if len(status) > 0 {
+		return string(out) + "-dirty", nil
+	}
+	return string(out), nil
+}
+
+// commitSubject returns the subject line of the commit at ref, or at HEAD if
+// ref is empty, truncated to fit a terminal line next to the ref name.
+func (c *Benchdiff) commitSubject(ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := c.runGitCmd("log", "-1", "--format=%s", "--end-of-options", ref)
+	if err != nil {
+		return "", err
+	}
+	const maxLen = 50
+	if subject := []rune(string(out)); len(subject) > maxLen {
+		return string(subject[:maxLen-1]) + "…", nil
+	}
+	return string(out), nil
+}
+
+// fetchIfMissing returns ref if it resolves to a local commit. Otherwise, it
+// fetches ref from remote, giving up after timeout if it's not zero, and
+// returns the hash of the fetched commit. In a shallow repository, only the
+// commit itself is fetched. A remote-tracking ref like origin/main is fetched
+// as the remote's main branch, and its remote-tracking ref is updated.
+func (c *Benchdiff) fetchIfMissing(remote, ref string, timeout time.Duration) (string, error) {
+	if _, err := c.runGitCmd("rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}"); err == nil {
+		return ref, nil
+	}
+	args := []string{"fetch", "--no-tags"}
+	if shallow, err := c.runGitCmd("rev-parse", "--is-shallow-repository"); err == nil && string(shallow) == "true" {
+		args = append(args, "--depth=1")
+	}
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	fmt.Fprintf(os.Stderr, "Fetching %s from %s.\n", ref, remote)
+	if _, err := c.runGitCmdContext(ctx, append(args, "--end-of-options", remote, fetchRefspec(remote, ref))...); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %v", timeout)
+		}
+		return "", err
+	}
+	out, err := c.runGitCmd("rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s from %s does not resolve to a commit", ref, remote)
+	}
+	return string(out), nil
+}
+
+// fetchRefspec returns the refspec to fetch ref from remote. The remote doesn't
+// know about its own name, so a remote-tracking ref like origin/main or
+// refs/remotes/origin/main becomes main:refs/remotes/origin/main.
+func fetchRefspec(remote, ref string) string {
+	for _, prefix := range []string{"refs/remotes/" + remote + "/", remote + "/"} {
+		if branch, ok := strings.CutPrefix(ref, prefix); ok && branch != "" {
+			return branch + ":refs/remotes/" + remote + "/" + branch
+		}
+	}
+	return ref
+}
+
+// commitBefore returns the most recent commit on HEAD that was committed
+// before t.
+func (c *Benchdiff) commitBefore(t time.Time) (string, error) {
+	out, err := c.runGitCmd("rev-list", "-1", "--before="+t.Format(time.RFC3339), "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("no commit on HEAD is older than %s", t.Format(time.RFC3339))
+	}
+	return string(out), nil
+}
+
+// latestTag returns the most recent tag reachable from HEAD. If pattern is not
+// empty, only tags matching the glob are considered.
+func (c *Benchdiff) latestTag(pattern string) (string, error) {
+	args := []string{"describe", "--tags", "--abbrev=0"}
+	if pattern != "" {
+		args = append(args, "--match", pattern)
+	}
+	out, err := c.runGitCmd(append(args, "HEAD")...)
+	if err != nil {
+		if pattern != "" {
+			return "", fmt.Errorf("no tag matching %q is reachable from HEAD: %w", pattern, err)
+		}
+		return "", fmt.Errorf("no tag is reachable from HEAD: %w", err)
+	}
+	return string(out), nil
+}
+
+// worktreeMu serializes adding and removing worktrees, which take locks in the
+// repository, for Benchdiff.Parallel.
+var worktreeMu sync.Mutex
+
+func (c *Benchdiff) runAtGitRef(ctx context.Context, ref string, fn func(path string)) error {
+	if c.DryRun {
+		worktree := filepath.Join(os.TempDir(), "benchdiff-worktree")
+		c.runOrPrint(exec.Command(c.gitPath(), "worktree", "add", "--quiet", "--detach", worktree, ref))
+		if c.Submodules {
+			c.runOrPrint(exec.Command(c.gitPath(), "-C", worktree, "submodule", "update", "--init", "--recursive"))
+		}
+		fn(worktree)
+		c.runOrPrint(exec.Command(c.gitPath(), "worktree", "remove", "--force", worktree))
+		return nil
+	}
 	worktree, err := os.MkdirTemp("", "benchdiff")
 	if err != nil {
 		return err
@@ -346,24 +1620,38 @@ func (c *Benchdiff) runAtGitRef(ref string, fn func(path string)) error {
 	defer func() {
 		rErr := os.RemoveAll(worktree)
 		if rErr != nil {
-			fmt.Printf("Could not delete temp directory: %s\n", worktree)
+			fmt.Fprintf(os.Stderr, "Warning: could not delete temporary directory %s: %v\n", worktree, rErr)
 		}
 	}()
 
-	_, err = c.runGitCmd("worktree", "add", "--quiet", "--detach", worktree, ref)
+	worktreeMu.Lock()
+	_, err = c.runGitCmdContext(ctx, "worktree", "add", "--quiet", "--detach", worktree, ref)
+	worktreeMu.Unlock()
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		_, cerr := c.runGitCmd("worktree", "remove", worktree)
+		// The worktree is ours to throw away, but git refuses to remove it
+		// without --force if the benchmarks left files in it, like
+		// -cpuprofile does, or if it has initialized submodules.
+		worktreeMu.Lock()
+		_, cerr := c.runGitCmd("worktree", "remove", "--force", worktree)
+		worktreeMu.Unlock()
 		if cerr != nil {
-			if exitErr, ok := cerr.(*exec.ExitError); ok {
-				fmt.Println(string(exitErr.Stderr))
-			}
-			fmt.Println(cerr)
+			fmt.Fprintf(os.Stderr, "Warning: could not remove worktree %s: %v\n", worktree, cerr)
 		}
 	}()
+
+	// The submodules are checked out in the temporary worktree, so the ones
+	// in the main worktree are left untouched.
+	if c.Submodules {
+		_, err = c.runGitCmdContext(ctx, "-C", worktree, "submodule", "update", "--init", "--recursive")
+		if err != nil {
+			return err
+		}
+	}
+
 	fn(worktree)
 	return nil
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resultLabels(r *RunResult) []string {
+	var labels []string
+	for _, label := range r.labels() {
+		labels = append(labels, *label)
+	}
+	return labels
+}
+
+func TestDisambiguate(t *testing.T) {
+	tests := []struct {
+		refs, want []string
+	}{
+		{[]string{"v1", "v2"}, []string{"v1", "v2"}},
+		{[]string{"abc123", "abc123"}, []string{"abc123", "abc123#2"}},
+		{[]string{"v1", "v1", "v1"}, []string{"v1", "v1#2", "v1#3"}},
+		{[]string{"v1", "v1", "v1#2"}, []string{"v1", "v1#3", "v1#2"}},
+		{[]string{"v1", "v2", "v1", "v2"}, []string{"v1", "v2", "v1#2", "v2#2"}},
+	}
+	for _, tt := range tests {
+		r := &RunResult{
+			BaseRef:   tt.refs[0],
+			ExtraRefs: slices.Clone(tt.refs[1 : len(tt.refs)-1]),
+			HeadRef:   tt.refs[len(tt.refs)-1],
+		}
+		r.disambiguate()
+		if got := resultLabels(r); !slices.Equal(got, tt.want) {
+			t.Errorf("disambiguate(%q) = %q, want %q", tt.refs, got, tt.want)
+		}
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		refs, labels, want []string
+		wantErr            bool
+	}{
+		{refs: []string{"v1", "v2"}, labels: []string{"old", "new"}, want: []string{"old", "new"}},
+		{refs: []string{"v1", "v2", "v3"}, labels: []string{"old"}, want: []string{"old", "v2", "v3"}},
+		{refs: []string{"v1", "v2"}, labels: []string{"v2"}, want: []string{"v2", "v2#2"}},
+		{refs: []string{"v1", "v1"}, labels: []string{"old"}, want: []string{"old", "v1"}},
+		{refs: []string{"v1", "v2"}, labels: []string{"a", "b", "c"}, wantErr: true},
+		{refs: []string{"v1", "v2"}, labels: []string{"a", "a"}, wantErr: true},
+		{refs: []string{"v1", "v2"}, labels: []string{"", "new"}, wantErr: true},
+		{refs: []string{"v1", "v2"}, labels: []string{"a=b", "new"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		r := &RunResult{
+			BaseRef:   tt.refs[0],
+			ExtraRefs: slices.Clone(tt.refs[1 : len(tt.refs)-1]),
+			HeadRef:   tt.refs[len(tt.refs)-1],
+		}
+		err := r.relabel(tt.labels)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("relabel(%q, %q) succeeded, want error", tt.refs, tt.labels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("relabel(%q, %q): %v", tt.refs, tt.labels, err)
+			continue
+		}
+		if got := resultLabels(r); !slices.Equal(got, tt.want) {
+			t.Errorf("relabel(%q, %q) = %q, want %q", tt.refs, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestGoTestArgs(t *testing.T) {
+	got := goTestArgs("^(BenchmarkA|BenchmarkB)$", 10, extraTestArgs("2s", false, []string{"./..."}))
+	want := []string{"test", "-run", "^$", "-bench", "^(BenchmarkA|BenchmarkB)$",
+		"-count", "10", "-benchtime", "2s", "./..."}
+	if !slices.Equal(got, want) {
+		t.Errorf("goTestArgs = %q, want %q", got, want)
+	}
+	if got := countArg(got); got != 10 {
+		t.Errorf("countArg(goTestArgs(..., 10, ...)) = %d, want 10", got)
+	}
+}
+
+func TestExtraTestArgs(t *testing.T) {
+	tests := []struct {
+		benchtime string
+		benchmem  bool
+		args      []string
+		want      []string
+	}{
+		{"", false, nil, nil},
+		{"", false, []string{"./..."}, []string{"./..."}},
+		{"2s", false, nil, []string{"-benchtime", "2s"}},
+		{"100x", false, nil, []string{"-benchtime", "100x"}},
+		{"", true, nil, []string{"-benchmem"}},
+		{"2s", true, []string{"-cpu", "1,4", "./..."},
+			[]string{"-benchtime", "2s", "-benchmem", "-cpu", "1,4", "./..."}},
+		// Flags after the double dash take precedence, by coming last.
+		{"2s", false, []string{"-benchtime", "5s"},
+			[]string{"-benchtime", "2s", "-benchtime", "5s"}},
+	}
+	for _, tt := range tests {
+		got := extraTestArgs(tt.benchtime, tt.benchmem, tt.args)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("extraTestArgs(%q, %v, %q) = %q, want %q", tt.benchtime, tt.benchmem, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCountArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"test", "-bench", "."}, 1},
+		{[]string{"test", "-count", "5"}, 5},
+		{[]string{"test", "-count=5"}, 5},
+		{[]string{"test", "--count", "5"}, 5},
+		{[]string{"test", "--count=5"}, 5},
+		{[]string{"test", "-count", "5", "-count", "3"}, 3},
+		{[]string{"test", "-count", "5", "-args", "-count", "3"}, 5},
+		{[]string{"test", "-count", "5", "--args", "-count=3"}, 5},
+		{[]string{"test", "-count", "0"}, 1},
+		{[]string{"test", "-count", "x"}, 1},
+		{[]string{"test", "-count"}, 1},
+	}
+	for _, tt := range tests {
+		if got := countArg(tt.args); got != tt.want {
+			t.Errorf("countArg(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
+
+// worktrees returns the paths of the worktrees of the repository in the
+// current directory, starting with the main one.
+func worktrees() ([]string, error) {
+	out, err := exec.Command("git", "worktree", "list", "--porcelain").Output()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func TestCancelRemovesWorktree(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test in a temporary repository")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/slow\n\ngo 1.22\n",
+		"slow_test.go": `package slow
+
+import (
+	"testing"
+	"time"
+)
+
+func BenchmarkSlow(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"commit", "--quiet", "-m", "slow"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(repo); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	c := &Benchdiff{
+		ResultsDir: t.TempDir(),
+		Debug:      log.New(io.Discard, "", 0),
+		Parallel:   true, // disables the progress bar
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Cancel as soon as the worktree exists.
+	worktree := make(chan string, 1)
+	go func() {
+		defer cancel()
+		for ctx.Err() == nil {
+			if paths, _ := worktrees(); len(paths) > 1 {
+				worktree <- paths[1]
+				time.Sleep(500 * time.Millisecond)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	filename := filepath.Join(c.ResultsDir, "slow.out")
+	args := goTestArgs(".", 100, nil)
+	if err := c.runBenchmark(ctx, "HEAD", args, filename, 100); err == nil {
+		t.Fatal("runBenchmark succeeded, want an error")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("runBenchmark finished before it was canceled")
+	}
+
+	if paths, err := worktrees(); err != nil {
+		t.Errorf("git worktree list: %v", err)
+	} else if len(paths) != 1 {
+		t.Errorf("worktrees left after canceling: %q", paths[1:])
+	}
+	if _, err := os.Stat(<-worktree); !os.IsNotExist(err) {
+		t.Errorf("worktree directory left after canceling: %v", err)
+	}
+	if fileExists(filename) {
+		t.Errorf("output file written after canceling")
+	}
+}
+
+func TestFetchRefspec(t *testing.T) {
+	tests := []struct {
+		ref, want string
+	}{
+		{"main", "main"},
+		{"v1.0.0", "v1.0.0"},
+		{"0123abcd", "0123abcd"},
+		{"origin/main", "main:refs/remotes/origin/main"},
+		{"origin/feature/x", "feature/x:refs/remotes/origin/feature/x"},
+		{"refs/remotes/origin/main", "main:refs/remotes/origin/main"},
+		{"upstream/main", "upstream/main"},
+		{"origin/", "origin/"},
+	}
+	for _, tt := range tests {
+		if got := fetchRefspec("origin", tt.ref); got != tt.want {
+			t.Errorf("fetchRefspec(origin, %q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+// gitOutput runs git in dir, and returns its trimmed output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestFetchIfMissing(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	upstream := t.TempDir()
+	gitOutput(t, upstream, "init", "--quiet", "--initial-branch", "main")
+	gitOutput(t, upstream, "commit", "--quiet", "--allow-empty", "-m", "one")
+	gitOutput(t, upstream, "checkout", "--quiet", "-b", "feature")
+	gitOutput(t, upstream, "commit", "--quiet", "--allow-empty", "-m", "two")
+	feature := gitOutput(t, upstream, "rev-parse", "HEAD")
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	gitOutput(t, upstream, "clone", "--quiet", "--single-branch", "--branch", "main",
+		"--depth", "1", "file://"+upstream, clone)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(clone); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	c := &Benchdiff{Debug: log.New(io.Discard, "", 0)}
+	got, err := c.fetchIfMissing("origin", "origin/feature", time.Minute)
+	if err != nil {
+		t.Fatalf("fetchIfMissing(origin/feature): %v", err)
+	}
+	if got != feature {
+		t.Errorf("fetchIfMissing(origin/feature) = %q, want %q", got, feature)
+	}
+	if got := gitOutput(t, clone, "rev-parse", "origin/feature"); got != feature {
+		t.Errorf("origin/feature = %q after fetching, want %q", got, feature)
+	}
+	// Now it's available locally.
+	if got, err := c.fetchIfMissing("origin", "origin/feature", time.Minute); err != nil || got != "origin/feature" {
+		t.Errorf("fetchIfMissing(origin/feature) again = %q, %v, want origin/feature", got, err)
+	}
+}
+
+func TestRemovedBenchmarksFilter(t *testing.T) {
+	if _, err := exec.LookPath("benchstat"); err != nil {
+		t.Skip("benchstat not found")
+	}
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	r := &RunResult{
+		BaseRef: "base",
+		HeadRef: "head",
+		BaseOutputFile: write("base.out", "pkg: example.com/p\n"+
+			"BenchmarkSum-2 1 100 ns/op\nBenchmarkAlloc-2 1 100 ns/op\nBenchmarkEq-2 1 100 ns/op\n"),
+		HeadOutputFile: write("head.out", "pkg: example.com/p\n"+
+			"BenchmarkSum-2 1 100 ns/op\n"),
+	}
+	for _, tt := range []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"example.com/p.BenchmarkAlloc", "example.com/p.BenchmarkEq"}},
+		{".name:Alloc", []string{"example.com/p.BenchmarkAlloc"}},
+		{".name:Sum", nil},
+	} {
+		r.Filter = tt.filter
+		got, err := r.removedBenchmarks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("-filter %q: removedBenchmarks() = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestBenchstatUnit(t *testing.T) {
+	for unit, want := range map[string]string{
+		"ns/op":     "sec/op",
+		"sec/op":    "sec/op",
+		"MB/s":      "B/s",
+		"B/s":       "B/s",
+		"allocs/op": "allocs/op",
+	} {
+		if got := benchstatUnit(unit); got != want {
+			t.Errorf("benchstatUnit(%q) = %q, want %q", unit, got, want)
+		}
+	}
+}
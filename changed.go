@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineRange is an inclusive range of line numbers.
+type lineRange struct{ start, end int }
+
+// changedBenchmarks returns the sorted names of the benchmark functions whose
+// declaration overlaps a change between the base and head refs, and of all
+// the benchmark functions in packages whose non-test Go files changed.
+//
+// A benchmark that calls a modified helper in another package or in a test
+// file is not reported.
+func (c *Benchdiff) changedBenchmarks() ([]string, error) {
+	diffArgs := []string{"diff", "--no-color", "--no-ext-diff", c.BaseRef}
+	if c.HeadRef != "" {
+		diffArgs = append(diffArgs, c.HeadRef)
+	}
+	diff, err := c.runGitCmd(slices.Concat(diffArgs, []string{"--unified=0",
+		"--src-prefix=a/", "--dst-prefix=b/", "--", "*_test.go"})...)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseDiffHunks(diff)
+	if err != nil {
+		return nil, err
+	}
+
+	changedCode, err := c.runGitCmd(slices.Concat(diffArgs,
+		[]string{"--name-only", "--", "*.go", ":!*_test.go"})...)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for _, path := range strings.Fields(string(changedCode)) {
+		dirs[filepath.ToSlash(filepath.Dir(path))] = true
+	}
+
+	rootPath, err := c.runGitCmd("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+
+	// Every benchmark in a package with changed code is affected, so treat
+	// its test files as changed in their entirety.
+	for dir := range dirs {
+		files, err := c.testFiles(string(rootPath), dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			changes[path] = []lineRange{{1, math.MaxInt}}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for path, ranges := range changes {
+		var src []byte
+		if c.HeadRef == "" {
+			src, err = os.ReadFile(filepath.Join(string(rootPath), path))
+		} else {
+			src, err = c.runGitCmd("show", c.HeadRef+":"+path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, src, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Benchmark") {
+				continue
+			}
+			start := fset.Position(fn.Pos()).Line
+			end := fset.Position(fn.End()).Line
+			for _, r := range ranges {
+				if r.start <= end && start <= r.end && !seen[fn.Name.Name] {
+					seen[fn.Name.Name] = true
+					names = append(names, fn.Name.Name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// testFiles returns the paths, relative to the repository root, of the test
+// files in dir at the head ref.
+func (c *Benchdiff) testFiles(rootPath, dir string) ([]string, error) {
+	var paths []string
+	if c.HeadRef == "" {
+		matches, err := filepath.Glob(filepath.Join(rootPath, dir, "*_test.go"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			path, err := filepath.Rel(rootPath, m)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, filepath.ToSlash(path))
+		}
+		return paths, nil
+	}
+	out, err := c.runGitCmd("ls-tree", "--full-tree", "--name-only", c.HeadRef, dir+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Split(string(out), "\n") {
+		if strings.HasSuffix(path, "_test.go") {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// parseDiffHunks parses the output of "git diff --unified=0" and returns, for
+// each file present in the new version, the line ranges touched by the diff.
+func parseDiffHunks(diff []byte) (map[string][]lineRange, error) {
+	changes := make(map[string][]lineRange)
+	var path string
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			path = ""
+			if p, ok := strings.CutPrefix(line, "+++ b/"); ok {
+				path = p
+			}
+		case strings.HasPrefix(line, "@@ ") && path != "":
+			// @@ -l,s +l,s @@ where the count is omitted when it's one.
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("malformed hunk header: %q", line)
+			}
+			startStr, countStr, ok := strings.Cut(fields[2][1:], ",")
+			if !ok {
+				countStr = "1"
+			}
+			start, err := strconv.Atoi(startStr)
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk header: %q", line)
+			}
+			count, err := strconv.Atoi(countStr)
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk header: %q", line)
+			}
+			// A pure deletion happens after line start, so it affects
+			// whatever declaration spans start and start+1.
+			end := start + count - 1
+			if count == 0 {
+				end = start + 1
+			}
+			changes[path] = append(changes[path], lineRange{start, end})
+		}
+	}
+	return changes, scanner.Err()
+}
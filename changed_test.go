@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiffHunks(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want map[string][]lineRange
+	}{
+		{"modification", `diff --git a/a_test.go b/a_test.go
+--- a/a_test.go
++++ b/a_test.go
+@@ -10,3 +10,4 @@ func BenchmarkA(b *testing.B) {
+@@ -30,2 +31,2 @@ func BenchmarkB(b *testing.B) {
+`, map[string][]lineRange{"a_test.go": {{10, 13}, {31, 32}}}},
+		{"omitted count", `--- a/a.go
++++ b/a.go
+@@ -5 +5 @@
+`, map[string][]lineRange{"a.go": {{5, 5}}}},
+		{"zero count", `--- a/a.go
++++ b/a.go
+@@ -7,2 +6,0 @@
+`, map[string][]lineRange{"a.go": {{6, 7}}}},
+		{"multiple files", `--- a/a.go
++++ b/a.go
+@@ -1,2 +1,3 @@
+--- a/b/b.go
++++ b/b/b.go
+@@ -4,0 +5,2 @@
+`, map[string][]lineRange{"a.go": {{1, 3}}, "b/b.go": {{5, 6}}}},
+		{"deleted file", `--- a/a.go
++++ /dev/null
+@@ -1,3 +0,0 @@
+--- a/b.go
++++ b/b.go
+@@ -1 +1 @@
+`, map[string][]lineRange{"b.go": {{1, 1}}}},
+		{"empty", "", map[string][]lineRange{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDiffHunks([]byte(tt.diff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, hdr := range []string{"@@ -1 @@", "@@ -1 +x,2 @@", "@@ -1 +1,y @@"} {
+		if _, err := parseDiffHunks([]byte("+++ b/a.go\n" + hdr + "\n")); err == nil {
+			t.Errorf("parseDiffHunks(%q) returned no error", hdr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An expectation is the expected value of one metric of one benchmark.
+type expectation struct {
+	Name      string
+	Value     float64
+	Unit      string
+	Tolerance float64 // in percent
+}
+
+// parseExpectations parses a file of expected benchmark values. Each line
+// has a benchmark name without the GOMAXPROCS suffix, a value with its unit
+// as reported by "go test", and the allowed drift in percent. For example
+//
+//	BenchmarkEncode/small	1500 ns/op	10%
+//	BenchmarkEncode/small	3 allocs/op	0%
+//
+// Empty lines and lines starting with # are ignored.
+func parseExpectations(path string) ([]expectation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var exps []expectation
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: want name, value, unit, and tolerance", path, n)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value %q", path, n, fields[1])
+		}
+		var tolerance percentFlag
+		if err := tolerance.Set(fields[3]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		exps = append(exps, expectation{
+			Name:      fields[0],
+			Value:     value,
+			Unit:      fields[2],
+			Tolerance: tolerance.value,
+		})
+	}
+	return exps, scanner.Err()
+}
+
+// benchmarkValues returns the values of every metric of every benchmark in
+// a "go test" output file, keyed by name without the GOMAXPROCS suffix and
+// then by unit.
+func benchmarkValues(path string) (map[string]map[string][]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]map[string][]float64)
+	for _, line := range strings.Split(string(data), "\n") {
+		name, _, ok := cutBenchmarkName(line)
+		if !ok {
+			continue
+		}
+		// Name, iterations, and then value and unit pairs.
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields)%2 != 0 {
+			continue
+		}
+		if values[name] == nil {
+			values[name] = make(map[string][]float64)
+		}
+		for i := 2; i < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			values[name][fields[i+1]] = append(values[name][fields[i+1]], v)
+		}
+	}
+	return values, nil
+}
+
+func median(s []float64) float64 {
+	s = append([]float64(nil), s...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// checkExpectations benchmarks the head ref and compares the median of each
+// metric against the expectations in path, reporting those that drifted or
+// are missing. It returns whether all expectations were met.
+func (c *Benchdiff) checkExpectations(ctx context.Context, path string) (bool, error) {
+	exps, err := parseExpectations(path)
+	if err != nil {
+		return false, err
+	}
+	ref, filename, err := c.RunHead(ctx)
+	if err != nil {
+		return false, err
+	}
+	values, err := benchmarkValues(filename)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for _, e := range exps {
+		samples := values[e.Name][e.Unit]
+		if len(samples) == 0 {
+			report("error", "expectation not measured", fmt.Sprintf("%s %s", e.Name, e.Unit))
+			ok = false
+			continue
+		}
+		got := median(samples)
+		drift := (got - e.Value) / e.Value * 100
+		if e.Value == 0 {
+			drift = 0
+			if got != 0 {
+				drift = math.Inf(1)
+			}
+		}
+		if math.Abs(drift) > e.Tolerance {
+			report("error", fmt.Sprintf("drift over %g%%", e.Tolerance),
+				fmt.Sprintf("%s %s: %g, expected %g (%+.2f%%)", e.Name, e.Unit, got, e.Value, drift))
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Fprintf(os.Stderr, "All %d expectations met at %s.\n", len(exps), ref)
+	}
+	return ok, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A change is the difference in one metric of one benchmark between the base
+// and another column.
+type change struct {
+	Pkg    string
+	Name   string
+	Unit   string
+	Column string
+
+	// Delta is the change in percent. It's only meaningful if Significant.
+	Delta       float64
+	Significant bool
+
+	P float64
+	N string
+}
+
+func (ch change) String() string {
+	name := ch.Name
+	if ch.Pkg != "" {
+		name = ch.Pkg + "." + name
+	}
+	return fmt.Sprintf("%s %s: %+.2f%% (p=%.3f n=%s)", name, ch.Unit, ch.Delta, ch.P, ch.N)
+}
+
+// regression returns the size of the change in percent, and whether it's a
+// significant change for the worse.
+func (ch change) regression() (float64, bool) {
+	if !ch.Significant {
+		return 0, false
+	}
+	if higherIsBetter(ch.Unit) {
+		return -ch.Delta, ch.Delta < 0
+	}
+	return ch.Delta, ch.Delta > 0
+}
+
+// higherIsBetter reports whether larger values of unit are improvements, as
+// is the case for throughputs like B/s, but not for sec/op or B/op.
+func higherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+// changes returns the changes in tables against their base column. Summary
+// rows such as the geomean, which have no p-value, are skipped.
+func changes(tables []*table) []change {
+	var changes []change
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			for _, c := range r.Values {
+				if c.P == nil {
+					continue
+				}
+				ch := change{
+					Pkg:    t.Pkg,
+					Name:   r.Name,
+					Unit:   t.Unit,
+					Column: c.Column,
+					P:      *c.P,
+					N:      c.N,
+				}
+				if c.Delta != nil {
+					ch.Delta = *c.Delta
+					ch.Significant = true
+				}
+				changes = append(changes, ch)
+			}
+		}
+	}
+	return changes
+}
+
+// removedBenchmarks returns the benchmarks in the base output file that are
+// missing from the head one. Only benchmarks selected by r.Filter count.
+func (r *RunResult) removedBenchmarks() ([]string, error) {
+	selected, err := r.selectedBenchmarks()
+	if err != nil {
+		return nil, err
+	}
+	base, err := benchmarkNames(r.BaseOutputFile, selected)
+	if err != nil {
+		return nil, err
+	}
+	head, err := benchmarkNames(r.HeadOutputFile, selected)
+	if err != nil {
+		return nil, err
+	}
+	inHead := make(map[string]bool)
+	for _, name := range head {
+		inHead[name] = true
+	}
+	var removed []string
+	for _, name := range base {
+		if !inHead[name] {
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
+
+// A mismatch is a benchmark that is present in some of the result files, but
+// missing from others.
+type mismatch struct {
+	Name      string
+	MissingAt []string // labels of the refs it's missing at
+}
+
+// mismatchedBenchmarks returns the benchmarks that are not present at every
+// ref, in order of first appearance from the base to the head ref. Only
+// benchmarks selected by r.Filter count.
+func (r *RunResult) mismatchedBenchmarks() ([]mismatch, error) {
+	selected, err := r.selectedBenchmarks()
+	if err != nil {
+		return nil, err
+	}
+	labels := append([]string{r.BaseRef}, r.ExtraRefs...)
+	labels = append(labels, r.HeadRef)
+	files := append([]string{r.BaseOutputFile}, r.ExtraOutputFiles...)
+	files = append(files, r.HeadOutputFile)
+
+	var all []string
+	present := make([]map[string]bool, len(files))
+	for i, f := range files {
+		names, err := benchmarkNames(f, selected)
+		if err != nil {
+			return nil, err
+		}
+		present[i] = make(map[string]bool)
+		for _, name := range names {
+			present[i][name] = true
+			if !slices.Contains(all, name) {
+				all = append(all, name)
+			}
+		}
+	}
+	var mismatched []mismatch
+	for _, name := range all {
+		var missingAt []string
+		for i := range files {
+			if !present[i][name] {
+				missingAt = append(missingAt, labels[i])
+			}
+		}
+		if missingAt != nil {
+			mismatched = append(mismatched, mismatch{Name: name, MissingAt: missingAt})
+		}
+	}
+	return mismatched, nil
+}
+
+// selectedBenchmarks returns the set of benchmarks selected by r.Filter,
+// named like benchmarkNames does, or nil if there is no filter.
+func (r *RunResult) selectedBenchmarks() (map[string]bool, error) {
+	if r.Filter == "" {
+		return nil, nil
+	}
+	out, err := r.benchstatCmd("-format", "csv").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running benchstat: %v", err)
+	}
+	tables, err := parseBenchstatCSV(out)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if row.Name == "geomean" {
+				continue
+			}
+			// benchstat keeps the GOMAXPROCS suffix in row names.
+			name, _, _ := cutBenchmarkName("Benchmark" + row.Name)
+			if t.Pkg != "" {
+				name = t.Pkg + "." + name
+			}
+			selected[name] = true
+		}
+	}
+	return selected, nil
+}
+
+// benchmarkNames returns the names of the benchmarks in a "go test" output
+// file, qualified by package, in order of first appearance. If selected is
+// not nil, only the benchmarks in it are returned.
+func benchmarkNames(path string, selected map[string]bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var pkg string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "pkg: "); ok {
+			pkg = v
+			continue
+		}
+		name, _, ok := cutBenchmarkName(line)
+		if !ok {
+			continue
+		}
+		if pkg != "" {
+			name = pkg + "." + name
+		}
+		if !seen[name] && (selected == nil || selected[name]) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// percentFlag is a flag.Value for a percentage, like "5%" or "5".
+type percentFlag struct {
+	set   bool
+	value float64
+}
+
+func (p *percentFlag) String() string {
+	if p == nil || !p.set {
+		return ""
+	}
+	return strconv.FormatFloat(p.value, 'f', -1, 64) + "%"
+}
+
+func (p *percentFlag) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid percentage %q", s)
+	}
+	if v < 0 {
+		return fmt.Errorf("negative percentage %q", s)
+	}
+	p.set, p.value = true, v
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// A job is one comparison in a run-jobs spec file, which is a JSON array of
+// objects like
+//
+//	{"base_ref": "v1.0.0", "head_ref": "main", "bench": "Encode", "count": 10, "output": "encode.txt"}
+//
+// All fields are optional. base_ref defaults to HEAD, head_ref to the
+// worktree, bench to ".", count to the -count flag, and output to standard
+// output.
+type job struct {
+	BaseRef string `json:"base_ref"`
+	HeadRef string `json:"head_ref"`
+	Bench   string `json:"bench"`
+	Count   int    `json:"count"`
+	Output  string `json:"output"`
+}
+
+// RunJobs runs the comparisons in the spec file at path, writing the
+// benchstat report of each to its output. count is the default number of
+// runs, and extraArgs are passed to every "go test" invocation. Since the jobs
+// share the cache, a ref and configuration benchmarked by an earlier job is
+// not benchmarked again.
+func (c *Benchdiff) RunJobs(ctx context.Context, path string, count int, extraArgs []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var jobs []job
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jobs); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	for i, j := range jobs {
+		if j.BaseRef == "" {
+			j.BaseRef = "HEAD"
+		}
+		if j.Bench == "" {
+			j.Bench = "."
+		}
+		if j.Count == 0 {
+			j.Count = count
+		}
+		if j.Count < 0 {
+			return fmt.Errorf("job %d: invalid count %d", i+1, j.Count)
+		}
+
+		jc := *c
+		jc.BaseRef, jc.HeadRef, jc.ExtraRefs = j.BaseRef, j.HeadRef, nil
+		jc.BaseBench, jc.HeadBench = "", ""
+		jc.AllowEmpty = false
+		jc.Live = nil
+		jc.BenchArgs = goTestArgs(j.Bench, j.Count, extraArgs)
+
+		head := j.HeadRef
+		if head == "" {
+			head = "worktree"
+		}
+		fmt.Fprintf(os.Stderr, "Job %d of %d: %s vs %s.\n", i+1, len(jobs), j.BaseRef, head)
+		result, err := jc.Run(ctx)
+		if err != nil {
+			return fmt.Errorf("job %d: %w", i+1, err)
+		}
+
+		cmd := result.benchstatCmd()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		var f *os.File
+		if j.Output != "" {
+			if f, err = os.Create(j.Output); err != nil {
+				return fmt.Errorf("job %d: %w", i+1, err)
+			}
+			cmd.Stdout = f
+		}
+		c.Debug.Printf("+ %s", cmd)
+		err = cmd.Run()
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("job %d: error running benchstat: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// interruptOnCancel is a no-op, leaving cmd to be killed when its context is
+// canceled.
+func interruptOnCancel(cmd *exec.Cmd) {}
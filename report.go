@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A table is one benchstat table: one metric of the benchmarks of one
+// package, across all compared columns. It's parsed from the output of
+// "benchstat -format csv", and is also the -format json schema.
+type table struct {
+	Pkg     string   `json:"pkg,omitempty"`
+	Unit    string   `json:"unit"`
+	Columns []string `json:"columns"`
+	Rows    []row    `json:"rows"`
+}
+
+type row struct {
+	Name   string `json:"name"`
+	Values []cell `json:"values"`
+}
+
+// A cell is the summary of one benchmark metric in one column. Delta, P, N,
+// and Change are set only for columns compared against the first one.
+type cell struct {
+	Column string   `json:"column"`
+	Center *float64 `json:"center"`
+	CI     string   `json:"ci,omitempty"`
+
+	// Delta is the change from the base column in percent. It's nil if the
+	// change is not significant or undefined, and in the geomean row, which
+	// has no p-value.
+	Delta *float64 `json:"delta,omitempty"`
+	P     *float64 `json:"p,omitempty"`
+	N     string   `json:"n,omitempty"`
+
+	// Change is "better", "worse", or "~" for no significant change.
+	Change string `json:"change,omitempty"`
+}
+
+// A tableColumn locates the fields of one column in a benchstat CSV record.
+// Indexes of absent fields are zero.
+type tableColumn struct {
+	label                    string
+	center, ci, delta, pAndN int
+}
+
+// parseBenchstatCSV parses the output of "benchstat -format csv".
+func parseBenchstatCSV(out []byte) ([]*table, error) {
+	var tables []*table
+	var pkg string
+	var labels []string
+	var t *table
+	var columns []tableColumn
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			labels, t = nil, nil
+			continue
+		}
+		if labels == nil && !strings.HasPrefix(line, ",") {
+			// A "key: value" configuration line between tables.
+			if v, ok := strings.CutPrefix(line, "pkg: "); ok {
+				pkg = v
+			}
+			continue
+		}
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return nil, fmt.Errorf("malformed benchstat output line %q: %v", line, err)
+		}
+		switch {
+		case labels == nil:
+			labels = record
+			continue
+		case t == nil:
+			t, columns = parseTableHeader(pkg, labels, record)
+			if t == nil {
+				return nil, fmt.Errorf("malformed benchstat table header %q", line)
+			}
+			tables = append(tables, t)
+			continue
+		}
+
+		field := func(i int) string {
+			if i == 0 || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+		r := row{Name: record[0]}
+		for _, col := range columns {
+			c := cell{Column: col.label, CI: field(col.ci)}
+			if v, err := strconv.ParseFloat(field(col.center), 64); err == nil {
+				c.Center = &v
+			}
+			for _, f := range strings.Fields(field(col.pAndN)) {
+				if v, ok := strings.CutPrefix(f, "p="); ok {
+					if p, err := strconv.ParseFloat(v, 64); err == nil {
+						c.P = &p
+					}
+				}
+				if v, ok := strings.CutPrefix(f, "n="); ok {
+					c.N = v
+				}
+			}
+			switch d := field(col.delta); {
+			case d == "~":
+				c.Change = "~"
+			case d != "" && c.P != nil:
+				// benchstat reports "?" when the delta is undefined. The
+				// geomean row has a delta but no p-value, and is skipped.
+				delta, err := strconv.ParseFloat(strings.TrimSuffix(d, "%"), 64)
+				if err != nil {
+					break
+				}
+				c.Delta = &delta
+				switch {
+				case delta == 0:
+					c.Change = "~"
+				case (delta > 0) == higherIsBetter(t.Unit):
+					c.Change = "better"
+				default:
+					c.Change = "worse"
+				}
+			}
+			r.Values = append(r.Values, c)
+		}
+		t.Rows = append(t.Rows, r)
+	}
+	return tables, scanner.Err()
+}
+
+// parseTableHeader parses the two header records of a benchstat CSV table,
+// which look like
+//
+//	,old,,new,,,
+//	,sec/op,CI,sec/op,CI,vs base,P
+func parseTableHeader(pkg string, labels, header []string) (*table, []tableColumn) {
+	var columns []tableColumn
+	for i := 1; i < len(header); i++ {
+		switch header[i] {
+		case "CI":
+			if len(columns) > 0 {
+				columns[len(columns)-1].ci = i
+			}
+		case "vs base":
+			if len(columns) > 0 {
+				columns[len(columns)-1].delta = i
+			}
+		case "P":
+			if len(columns) > 0 {
+				columns[len(columns)-1].pAndN = i
+			}
+		default:
+			if i >= len(labels) {
+				return nil, nil
+			}
+			columns = append(columns, tableColumn{label: labels[i], center: i})
+		}
+	}
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	t := &table{Pkg: pkg, Unit: header[columns[0].center]}
+	for _, col := range columns {
+		t.Columns = append(t.Columns, col.label)
+	}
+	return t, columns
+}
+
+// redelimit re-encodes the output of "benchstat -format csv" with the given
+// field separator, either ',' or '\t', optionally dropping the confidence
+// interval columns. Configuration lines are kept as they are, unless there
+// are no tables at all, in which case the output is empty.
+//
+// If flat is true, the tables are merged into one, with a single header row,
+// and the package and unit of each row in the first two columns. The header
+// names the other columns after their benchstat label, like "old", "old CI",
+// "new", "new vs base", and "new P". Configuration lines are dropped.
+//
+// For '\t', fields are not quoted, and fields containing tabs are rejected.
+func redelimit(out []byte, sep rune, noRange, flat bool) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = sep
+	var drop map[int]bool
+	write := func(record []string) error {
+		var fields []string
+		for i, f := range record {
+			j := i
+			if flat {
+				j -= 2 // drop doesn't count the pkg and unit columns
+			}
+			if j < 0 || !drop[j] {
+				fields = append(fields, f)
+			}
+		}
+		if sep != '\t' {
+			return w.Write(fields)
+		}
+		for _, f := range fields {
+			if strings.ContainsAny(f, "\t\n") {
+				return fmt.Errorf("field %q contains a tab or newline", f)
+			}
+		}
+		buf.WriteString(strings.Join(fields, "\t") + "\n")
+		return nil
+	}
+
+	var hasTables, inTable bool
+	var labels, flatHeader []string
+	var pkg, unit string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || !inTable && !strings.HasPrefix(line, ",") {
+			inTable = false
+			if flat {
+				if v, ok := strings.CutPrefix(line, "pkg: "); ok {
+					pkg = v
+				}
+				continue
+			}
+			w.Flush()
+			buf.WriteString(line + "\n")
+			continue
+		}
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return nil, fmt.Errorf("malformed benchstat output line %q: %v", line, err)
+		}
+		switch {
+		case !inTable:
+			// The labels row is written once the header row below it tells
+			// which columns are confidence intervals.
+			inTable, hasTables = true, true
+			labels = record
+			continue
+		case labels != nil && flat:
+			unit = record[1]
+			header := []string{"pkg", "unit", "name"}
+			var label string
+			for i, h := range record[1:] {
+				if labels[i+1] != "" {
+					label = labels[i+1]
+				}
+				if h == unit {
+					header = append(header, label)
+				} else {
+					header = append(header, label+" "+h)
+				}
+			}
+			labels = nil
+			if flatHeader == nil {
+				drop = make(map[int]bool)
+				for i, h := range record {
+					if noRange && h == "CI" {
+						drop[i] = true
+					}
+				}
+				flatHeader = header
+				if err := write(header); err != nil {
+					return nil, err
+				}
+			} else if !slices.Equal(header, flatHeader) {
+				return nil, fmt.Errorf("tables have different columns, %q and %q", flatHeader, header)
+			}
+			continue
+		case labels != nil:
+			drop = make(map[int]bool)
+			for i, h := range record {
+				if noRange && h == "CI" {
+					drop[i] = true
+				}
+			}
+			if err := write(labels); err != nil {
+				return nil, err
+			}
+			labels = nil
+		}
+		if flat {
+			record = append([]string{pkg, unit}, record...)
+		}
+		if err := write(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !hasTables {
+		return nil, nil
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// applyAlphas marks the changes in tables as not significant unless their
+// p-value is below alphaWorse, for changes for the worse, or alphaBetter, for
+// changes for the better.
+func applyAlphas(tables []*table, alphaBetter, alphaWorse float64) {
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			for i := range r.Values {
+				c := &r.Values[i]
+				if c.P == nil || c.Delta == nil {
+					continue
+				}
+				alpha := alphaBetter
+				if c.Change == "worse" {
+					alpha = alphaWorse
+				}
+				if *c.P >= alpha {
+					c.Delta, c.Change = nil, "~"
+				}
+			}
+		}
+	}
+}
+
+// writeReport writes report to w, failing if any of it couldn't be written,
+// including on a short write that the writer didn't report as an error.
+func writeReport(w io.Writer, report []byte) error {
+	n, err := w.Write(report)
+	if err == nil && n < len(report) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// deltaRE matches a delta in benchstat's text output, which is followed by
+// its p-value unlike the delta of geomean rows.
+var deltaRE = regexp.MustCompile(`([+-][0-9]+(?:\.[0-9]+)?%|~)( \(p=)`)
+
+// colorize adds ANSI colors to the deltas in benchstat's text output: green
+// for improvements, red for regressions, and dim for no significant change.
+func colorize(text []byte) []byte {
+	const (
+		green = "\x1b[32m"
+		red   = "\x1b[31m"
+		dim   = "\x1b[2m"
+		reset = "\x1b[0m"
+	)
+	var out strings.Builder
+	var unit string
+	for _, line := range strings.SplitAfter(string(text), "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+			unit = ""
+		case strings.Contains(line, "│"):
+			// The second header row has the units, like
+			// "│ sec/op │ sec/op vs base │".
+			if strings.Contains(line, "vs base") {
+				unit = strings.Fields(strings.ReplaceAll(line, "│", " "))[0]
+			}
+		case unit != "":
+			line = deltaRE.ReplaceAllStringFunc(line, func(m string) string {
+				delta, rest := m[:strings.Index(m, " ")], m[strings.Index(m, " "):]
+				color := dim
+				if delta != "~" {
+					color = red
+					if (delta[0] == '+') == higherIsBetter(unit) {
+						color = green
+					}
+				}
+				return color + delta + reset + rest
+			})
+		}
+		out.WriteString(line)
+	}
+	return []byte(out.String())
+}
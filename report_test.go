@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestColorize(t *testing.T) {
+	const (
+		green = "\x1b[32m"
+		red   = "\x1b[31m"
+		dim   = "\x1b[2m"
+		reset = "\x1b[0m"
+	)
+	header := func(unit string) string {
+		return "        │    old     │               new                │\n" +
+			"        │   " + unit + "   │   " + unit + "    vs base               │\n"
+	}
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "regression",
+			in:   header("sec/op") + "Sum    400.0n ± 1%   800.0n ± 2%  +100.00% (p=0.002 n=6)\n",
+			want: header("sec/op") + "Sum    400.0n ± 1%   800.0n ± 2%  " + red + "+100.00%" + reset + " (p=0.002 n=6)\n",
+		},
+		{
+			name: "improvement",
+			in:   header("sec/op") + "Sum    400.0n ± 1%   200.0n ± 2%  -50.00% (p=0.002 n=6)\n",
+			want: header("sec/op") + "Sum    400.0n ± 1%   200.0n ± 2%  " + green + "-50.00%" + reset + " (p=0.002 n=6)\n",
+		},
+		{
+			name: "throughput improvement",
+			in:   header("B/s") + "Sum    1.0Gi ± 1%   2.0Gi ± 2%  +100.00% (p=0.002 n=6)\n",
+			want: header("B/s") + "Sum    1.0Gi ± 1%   2.0Gi ± 2%  " + green + "+100.00%" + reset + " (p=0.002 n=6)\n",
+		},
+		{
+			name: "no change",
+			in:   header("sec/op") + "Sum    400.0n ± 1%   401.0n ± 2%  ~ (p=0.310 n=6)\n",
+			want: header("sec/op") + "Sum    400.0n ± 1%   401.0n ± 2%  " + dim + "~" + reset + " (p=0.310 n=6)\n",
+		},
+		{
+			name: "geomean",
+			in:   header("sec/op") + "geomean    400.0n    800.0n  +100.00%\n",
+			want: header("sec/op") + "geomean    400.0n    800.0n  +100.00%\n",
+		},
+		{
+			name: "outside a table",
+			in:   "pkg: example.com/x\n+100.00% (p=0.002 n=6)\n",
+			want: "pkg: example.com/x\n+100.00% (p=0.002 n=6)\n",
+		},
+		{
+			name: "single column",
+			in:   "        │    old     │\n        │   sec/op   │\nSum    400.0n ± 1%\n",
+			want: "        │    old     │\n        │   sec/op   │\nSum    400.0n ± 1%\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(colorize([]byte(tt.in))); got != tt.want {
+				t.Errorf("colorize:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingWriter accepts n bytes, then fails.
+type failingWriter struct {
+	n       int
+	written []byte
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.written = append(w.written, p[:w.n]...)
+		n := w.n
+		w.n = 0
+		return n, errors.New("disk full")
+	}
+	w.written = append(w.written, p...)
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// shortWriter accepts n bytes, and silently drops the rest.
+type shortWriter struct{ n int }
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	return min(len(p), w.n), nil
+}
+
+func TestWriteReport(t *testing.T) {
+	report := []byte("goos: linux\ngoarch: amd64\n")
+	for _, n := range []int{0, 1, len(report) - 1} {
+		w := &failingWriter{n: n}
+		if err := writeReport(w, report); err == nil {
+			t.Errorf("writeReport with a writer failing after %d bytes succeeded", n)
+		}
+		if err := writeReport(&shortWriter{n: n}, report); err != io.ErrShortWrite {
+			t.Errorf("writeReport with a writer dropping bytes after %d = %v, want %v", n, err, io.ErrShortWrite)
+		}
+	}
+	w := &failingWriter{n: len(report)}
+	if err := writeReport(w, report); err != nil {
+		t.Errorf("writeReport: %v", err)
+	}
+	if !bytes.Equal(w.written, report) {
+		t.Errorf("writeReport wrote %q, want %q", w.written, report)
+	}
+}
+
+func TestApplyAlphas(t *testing.T) {
+	p := func(v float64) *float64 { return &v }
+	tables := []*table{{Unit: "sec/op", Rows: []row{{Name: "Sum", Values: []cell{
+		{Column: "old"},
+		{Column: "worse", Delta: p(10), P: p(0.03), Change: "worse"},
+		{Column: "worse strong", Delta: p(10), P: p(0.002), Change: "worse"},
+		{Column: "better", Delta: p(-10), P: p(0.03), Change: "better"},
+		{Column: "better weak", Delta: p(-10), P: p(0.08), Change: "better"},
+		{Column: "same", P: p(0.5), Change: "~"},
+	}}}}}
+	applyAlphas(tables, 0.05, 0.01)
+	want := map[string]string{
+		"old": "", "worse": "~", "worse strong": "worse",
+		"better": "better", "better weak": "~", "same": "~",
+	}
+	for _, c := range tables[0].Rows[0].Values {
+		if c.Change != want[c.Column] {
+			t.Errorf("%s: change %q, want %q", c.Column, c.Change, want[c.Column])
+		}
+		if (c.Delta != nil) != (c.Change == "worse" || c.Change == "better") {
+			t.Errorf("%s: change %q with delta %v", c.Column, c.Change, c.Delta)
+		}
+	}
+}
+
+const benchstatCSV = `goos: linux
+goarch: amd64
+pkg: example.com/a
+,old,,new,,,
+,sec/op,CI,sec/op,CI,vs base,P
+Sum-8,1.0045e-07,0%,1.5055e-07,0%,+49.88%,p=0.002 n=6
+Eq-8,5e-08,0%,5e-08,0%,~,p=1.000 n=6
+geomean,7.086959855960806e-08,,8.676116642830466e-08,,+22.42%,
+
+,old,,new,,,
+,B/s,CI,B/s,CI,vs base,P
+Sum-8,1000,1%,1500,2%,+50.00%,p=0.002 n=6
+geomean,1000,,1500,,+50.00%,
+
+pkg: example.com/b
+,old,,new,,,
+,allocs/op,CI,allocs/op,CI,vs base,P
+X,0,∞,2.5,∞,?,p=0.029 n=4
+Y,4,0%,4,0%,+0.00%,p=0.002 n=6
+geomean,,,2.5,,?,
+`
+
+func TestParseBenchstatCSV(t *testing.T) {
+	tables, err := parseBenchstatCSV([]byte(benchstatCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		pkg, unit, row string
+		center         float64
+		delta          float64 // NaN if nil
+		p              float64 // NaN if nil
+		n, change      string
+	}
+	nan := math.NaN()
+	wants := []want{
+		{"example.com/a", "sec/op", "Sum-8", 1.5055e-07, 49.88, 0.002, "6", "worse"},
+		{"example.com/a", "sec/op", "Eq-8", 5e-08, nan, 1, "6", "~"},
+		{"example.com/a", "sec/op", "geomean", 8.676116642830466e-08, nan, nan, "", ""},
+		{"example.com/a", "B/s", "Sum-8", 1500, 50, 0.002, "6", "better"},
+		{"example.com/a", "B/s", "geomean", 1500, nan, nan, "", ""},
+		{"example.com/b", "allocs/op", "X", 2.5, nan, 0.029, "4", ""},
+		{"example.com/b", "allocs/op", "Y", 4, 0, 0.002, "6", "~"},
+		{"example.com/b", "allocs/op", "geomean", 2.5, nan, nan, "", ""},
+	}
+	var got []want
+	for _, tb := range tables {
+		if !slices.Equal(tb.Columns, []string{"old", "new"}) {
+			t.Errorf("%s %s: columns %q", tb.Pkg, tb.Unit, tb.Columns)
+		}
+		for _, r := range tb.Rows {
+			if len(r.Values) != 2 {
+				t.Fatalf("%s %s %s: %d values", tb.Pkg, tb.Unit, r.Name, len(r.Values))
+			}
+			if base := r.Values[0]; base.Delta != nil || base.P != nil || base.Change != "" {
+				t.Errorf("%s %s %s: base column has a comparison: %+v", tb.Pkg, tb.Unit, r.Name, base)
+			}
+			c := r.Values[1]
+			w := want{tb.Pkg, tb.Unit, r.Name, nan, nan, nan, c.N, c.Change}
+			if c.Center != nil {
+				w.center = *c.Center
+			}
+			if c.Delta != nil {
+				w.delta = *c.Delta
+			}
+			if c.P != nil {
+				w.p = *c.P
+			}
+			got = append(got, w)
+		}
+	}
+	eq := func(a, b float64) bool { return a == b || math.IsNaN(a) && math.IsNaN(b) }
+	if len(got) != len(wants) {
+		t.Fatalf("got %d rows, want %d:\n%+v", len(got), len(wants), got)
+	}
+	for i, w := range wants {
+		g := got[i]
+		if g.pkg != w.pkg || g.unit != w.unit || g.row != w.row || !eq(g.center, w.center) ||
+			!eq(g.delta, w.delta) || !eq(g.p, w.p) || g.n != w.n || g.change != w.change {
+			t.Errorf("row %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestParseBenchstatCSVMalformed(t *testing.T) {
+	for _, in := range []string{
+		",old,,new\n,CI,CI\n",
+		",old\n,sec/op,CI,sec/op\n",
+		",old,,new\n,sec/op,CI,\"sec/op\n",
+	} {
+		if tables, err := parseBenchstatCSV([]byte(in)); err == nil {
+			t.Errorf("parseBenchstatCSV(%q) = %v, want error", in, tables)
+		}
+	}
+	if tables, err := parseBenchstatCSV([]byte("goos: linux\n")); err != nil || tables != nil {
+		t.Errorf("parseBenchstatCSV without tables = %v, %v", tables, err)
+	}
+}
+
+func TestRedelimit(t *testing.T) {
+	const in = `pkg: example.com/a
+,old,,new,,,
+,sec/op,CI,sec/op,CI,vs base,P
+Sum,1e-07,0%,1.5e-07,1%,+50.00%,p=0.002 n=6
+geomean,1e-07,,1.5e-07,,+50.00%,
+
+,old,,new,,,
+,B/op,CI,B/op,CI,vs base,P
+Sum,64,0%,64,0%,~,p=1.000 n=6
+geomean,64,,64,,+0.00%,
+`
+	tests := []struct {
+		name          string
+		sep           rune
+		noRange, flat bool
+		want          string
+	}{
+		{"csv", ',', false, false, in},
+		{"tsv", '\t', false, false, `pkg: example.com/a
+	old		new			
+	sec/op	CI	sec/op	CI	vs base	P
+Sum	1e-07	0%	1.5e-07	1%	+50.00%	p=0.002 n=6
+geomean	1e-07		1.5e-07		+50.00%	
+
+	old		new			
+	B/op	CI	B/op	CI	vs base	P
+Sum	64	0%	64	0%	~	p=1.000 n=6
+geomean	64		64		+0.00%	
+`},
+		{"csv no range", ',', true, false, `pkg: example.com/a
+,old,new,,
+,sec/op,sec/op,vs base,P
+Sum,1e-07,1.5e-07,+50.00%,p=0.002 n=6
+geomean,1e-07,1.5e-07,+50.00%,
+
+,old,new,,
+,B/op,B/op,vs base,P
+Sum,64,64,~,p=1.000 n=6
+geomean,64,64,+0.00%,
+`},
+		{"flat", ',', false, true, `pkg,unit,name,old,old CI,new,new CI,new vs base,new P
+example.com/a,sec/op,Sum,1e-07,0%,1.5e-07,1%,+50.00%,p=0.002 n=6
+example.com/a,sec/op,geomean,1e-07,,1.5e-07,,+50.00%,
+example.com/a,B/op,Sum,64,0%,64,0%,~,p=1.000 n=6
+example.com/a,B/op,geomean,64,,64,,+0.00%,
+`},
+		{"flat tsv no range", '\t', true, true, `pkg	unit	name	old	new	new vs base	new P
+example.com/a	sec/op	Sum	1e-07	1.5e-07	+50.00%	p=0.002 n=6
+example.com/a	sec/op	geomean	1e-07	1.5e-07	+50.00%	
+example.com/a	B/op	Sum	64	64	~	p=1.000 n=6
+example.com/a	B/op	geomean	64	64	+0.00%	
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redelimit([]byte(in), tt.sep, tt.noRange, tt.flat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no tables", func(t *testing.T) {
+		got, err := redelimit([]byte("goos: linux\ngoarch: amd64\n"), ',', false, false)
+		if err != nil || len(got) != 0 {
+			t.Errorf("got %q, %v, want empty output", got, err)
+		}
+	})
+	t.Run("tab in field", func(t *testing.T) {
+		if _, err := redelimit([]byte(",old\n,sec/op\n\"a\tb\",1\n"), '\t', false, false); err == nil {
+			t.Error("got no error for a field with a tab")
+		}
+	})
+	t.Run("flat with different columns", func(t *testing.T) {
+		in := ",old,,new,,,\n,sec/op,CI,sec/op,CI,vs base,P\nSum,1,0%,2,0%,+100.00%,p=0.002 n=6\n\n" +
+			",old,\n,B/op,CI\nSum,64,0%\n"
+		if _, err := redelimit([]byte(in), ',', false, true); err == nil {
+			t.Error("got no error for tables with different columns")
+		}
+	})
+}
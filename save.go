@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// saveResult copies the "go test" output of each ref in result to dir, as
+// <label>.txt, and returns the paths of the copies. Slashes in labels, like
+// in branch names, are replaced with underscores, and a duplicate name gets
+// its position appended.
+func saveResult(result *RunResult, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	labels := append([]string{result.BaseRef}, result.ExtraRefs...)
+	labels = append(labels, result.HeadRef)
+	files := append([]string{result.BaseOutputFile}, result.ExtraOutputFiles...)
+	files = append(files, result.HeadOutputFile)
+
+	var saved []string
+	for i, label := range labels {
+		data, err := os.ReadFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ReplaceAll(label, "/", "_")
+		path := filepath.Join(dir, name+".txt")
+		if slices.Contains(saved, path) {
+			// Only "/" and "_" differ between the labels.
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d.txt", name, i+1))
+		}
+		if err := os.WriteFile(path, data, 0o666); err != nil {
+			return nil, err
+		}
+		saved = append(saved, path)
+	}
+	return saved, nil
+}